@@ -1,6 +1,11 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -12,8 +17,16 @@ type Config struct {
 	UseSSL             bool          `envconfig:"USE_SSL"`
 	SSLCertfilePath    string        `envconfig:"SSL_CERTIFICATE_PATH"`
 	SSLKeyPath         string        `envconfig:"SSL_KEY_PATH"`
+	PublicBaseURL      string        `envconfig:"PUBLIC_BASE_URL"`
 	SiteURL            string        `envconfig:"SITE_URL"`
 	Port               string        `envconfig:"PORT"`
+	APIToken           string        `envconfig:"API_TOKEN"`
+	PickAvoidDays      int           `envconfig:"PICK_AVOID_DAYS"`
+	PopularItemsCount  int           `envconfig:"POPULAR_ITEMS_COUNT"`
+	UploadDir          string        `envconfig:"UPLOAD_DIR"`
+	SeedFile           string        `envconfig:"SEED_FILE"`
+	PDFFontPath        string        `envconfig:"PDF_FONT_PATH"`
+	ReportLinkTTL      time.Duration `envconfig:"REPORT_LINK_TTL"`
 	DBUsername         string        `envconfig:"DB_USERNAME"`
 	DBPassword         string        `envconfig:"DB_PASSWORD"`
 	DBURL              string        `envconfig:"DB_URL"`
@@ -29,5 +42,43 @@ func LoadEnvVariables() (*Config, error) {
 	if err := envconfig.Process("", s); err != nil {
 		return nil, err
 	}
+	baseURL, err := parsePublicBaseURL(s)
+	if err != nil {
+		return nil, err
+	}
+	s.PublicBaseURL = baseURL
 	return s, nil
 }
+
+// parsePublicBaseURL validates the URL at which the server is reachable from the outside, such as behind a reverse
+// proxy, and returns it without a trailing slash so that paths can be appended. Without PUBLIC_BASE_URL it falls
+// back to SITE_URL with PORT, as links were built before it existed.
+func parsePublicBaseURL(s *Config) (string, error) {
+	raw, legacy := s.PublicBaseURL, false
+	if raw == "" {
+		if s.SiteURL == "" {
+			return "", errors.New("PUBLIC_BASE_URL is required, e.g. https://example.com")
+		}
+		raw, legacy = s.SiteURL, true
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid PUBLIC_BASE_URL %q: %w", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid PUBLIC_BASE_URL %q: must be an absolute http or https URL", raw)
+	}
+	if u.User != nil || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return "", fmt.Errorf("invalid PUBLIC_BASE_URL %q: must not have credentials, a query or a fragment", raw)
+	}
+	if legacy && u.Port() == "" && s.Port != "" {
+		u.Host = net.JoinHostPort(u.Hostname(), s.Port)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	return u.String(), nil
+}
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// downloadLinkTTL is how long signed download links stay valid.
+const downloadLinkTTL = 24 * time.Hour
+
+// APIAuthMiddleware authenticates API requests. Requests carry either the API token as a bearer token, or,
+// for downloads, a signature created by signedURL.
+func (a *AppHandler) APIAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.Config.APIToken == "" {
+			c.String(http.StatusUnauthorized, "API is disabled")
+			c.Abort()
+			return
+		}
+
+		token, hasToken := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if hasToken && hmac.Equal([]byte(token), []byte(a.Config.APIToken)) {
+			c.Next()
+			return
+		}
+		if c.Request.Method == http.MethodGet && a.verifySignature(c.Request.URL.Path, c.Request.URL.Query()) {
+			c.Next()
+			return
+		}
+
+		c.String(http.StatusUnauthorized, "Unauthorized")
+		c.Abort()
+	}
+}
+
+// signedURL returns a public URL of path with query that can be downloaded without the API token until it expires.
+func (a *AppHandler) signedURL(path string, expires time.Time, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", a.urlSignature(path, query))
+	return a.publicURL(path) + "?" + query.Encode()
+}
+
+// verifySignature checks a signature created by signedURL, which covers the path and every other query parameter,
+// and that it has not expired.
+func (a *AppHandler) verifySignature(path string, query url.Values) bool {
+	exp, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	signed := url.Values{}
+	for key, values := range query {
+		if key != "signature" {
+			signed[key] = values
+		}
+	}
+	return hmac.Equal([]byte(query.Get("signature")), []byte(a.urlSignature(path, signed)))
+}
+
+// urlSignature signs a path with its query, which is encoded sorted by key.
+func (a *AppHandler) urlSignature(path string, query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(a.Config.APIToken))
+	mac.Write([]byte(path + "?" + query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ExportMenuCSVHandler serves the menu of a restaurant as CSV.
+func (a *AppHandler) ExportMenuCSVHandler(c *gin.Context) {
+	file, ok := a.loadMenuFile(c)
+	if !ok {
+		return
+	}
+	setAttachment(c, "menu", file.Name, "csv")
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	if err := encodeMenuCSV(c.Writer, file); err != nil {
+		a.Logger.WithError(err).Errorf("無法匯出 %s 菜單", file.Name)
+	}
+}
+
+// ExportMenuJSONHandler serves the menu of a restaurant as JSON.
+func (a *AppHandler) ExportMenuJSONHandler(c *gin.Context) {
+	file, ok := a.loadMenuFile(c)
+	if !ok {
+		return
+	}
+	setAttachment(c, "menu", file.Name, "json")
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	if err := encodeMenuJSON(c.Writer, file); err != nil {
+		a.Logger.WithError(err).Errorf("無法匯出 %s 菜單", file.Name)
+	}
+}
+
+// loadMenuFile loads the menu of the restaurant in the request path, replying with an error if it fails.
+func (a *AppHandler) loadMenuFile(c *gin.Context) (*MenuFile, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid restaurant ID")
+		return nil, false
+	}
+
+	restaurant, err := a.RestaurantRepo.GetRestaurantByID(uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "Restaurant not found")
+		} else {
+			a.Logger.WithError(err).Errorf("無法取得 ID %d 的餐廳資訊", id)
+			c.String(http.StatusInternalServerError, "Internal server error")
+		}
+		return nil, false
+	}
+	return newMenuFile(restaurant), true
+}
+
+// setAttachment makes the response a download named name, or fallback for clients without UTF-8 file names.
+func setAttachment(c *gin.Context, fallback, name, ext string) {
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"; filename*=UTF-8''%s.%s`, fallback, ext, url.PathEscape(name), ext))
+}
+
+// ImportMenuHandler creates or updates restaurants and their menus from a CSV or JSON menu file in the request
+// body, in the format served by the export handlers.
+func (a *AppHandler) ImportMenuHandler(c *gin.Context) {
+	var files []*MenuFile
+	var err error
+	switch c.ContentType() {
+	case "text/csv":
+		files, err = decodeMenuCSV(c.Request.Body)
+	case "application/json":
+		files, err = decodeMenuJSON(c.Request.Body)
+	default:
+		c.String(http.StatusUnsupportedMediaType, "Content-Type must be text/csv or application/json")
+		return
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, file := range files {
+		if err := file.validate(); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	var sb strings.Builder
+	for _, file := range files {
+		summary, err := a.importMenuFile(file)
+		if err != nil {
+			c.String(http.StatusInternalServerError, sb.String()+"無法匯入 "+file.Name)
+			return
+		}
+		sb.WriteString(summary)
+	}
+	c.String(http.StatusOK, sb.String())
+}
+
+// importMenuFile creates or updates a restaurant and its menu items from a validated MenuFile and describes
+// the changes.
+func (a *AppHandler) importMenuFile(file *MenuFile) (string, error) {
+	restaurant := &models.Restaurant{
+		Name:         file.Name,
+		Tel:          file.Tel,
+		Address:      file.Address,
+		MinimumOrder: file.MinimumOrder,
+		DeliveryFee:  file.DeliveryFee,
+		ServiceMode:  models.ServiceMode(file.ServiceMode),
+		Notes:        file.Notes,
+	}
+	previous, err := a.RestaurantRepo.UpsertRestaurant(restaurant)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法匯入 %s 餐廳", file.Name)
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString(describeRestaurantUpsert(previous, restaurant))
+	if file.OpeningHours != "" {
+		openingHours, err := parseOpeningHours(file.OpeningHours)
+		if err != nil {
+			return "", err
+		}
+		if err := a.RestaurantRepo.SetOpeningHours(restaurant.ID, openingHours); err != nil {
+			a.Logger.WithError(err).Errorf("無法匯入 %s 營業時間", file.Name)
+			return "", err
+		}
+	}
+
+	if len(file.Tags) > 0 {
+		if err := a.RestaurantRepo.AddRestaurantTags(restaurant.ID, file.Tags); err != nil {
+			a.Logger.WithError(err).Errorf("無法匯入 %s 標籤", file.Name)
+			return "", err
+		}
+	}
+	if len(file.Aliases) > 0 {
+		if err := a.importAliases(restaurant.ID, file); err != nil {
+			return "", err
+		}
+	}
+
+	menuItems := make(map[string]*models.MenuItem)
+	for _, item := range file.Items {
+		menuItem := &models.MenuItem{Code: item.Code, Name: item.Name, Price: item.Price, RestaurantID: restaurant.ID}
+		previous, err := a.MenuItemRepo.UpsertMenuItem(menuItem)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法匯入 %s 餐點 %s", file.Name, item.Name)
+			return "", err
+		}
+		sb.WriteString(describeMenuItemUpsert(previous, menuItem))
+		menuItems[item.Name] = menuItem
+	}
+
+	// Combos go last, as their options may be listed after them
+	for _, item := range file.Items {
+		if len(item.Slots) > 0 {
+			if err := a.importComboSlots(restaurant, menuItems, item); err != nil {
+				return "", err
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+// importComboSlots sets the slots of an imported combo. Options are looked up among the imported items, then among
+// the other items of the restaurant.
+func (a *AppHandler) importComboSlots(restaurant *models.Restaurant, menuItems map[string]*models.MenuItem, item *MenuFileItem) error {
+	var slots []*models.ComboSlot
+	for _, slot := range item.Slots {
+		comboSlot := &models.ComboSlot{Name: slot.Name}
+		for _, name := range slot.Options {
+			option, ok := menuItems[name]
+			if !ok {
+				var err error
+				if option, err = a.MenuItemRepo.GetMenuItemByDetails(name, restaurant.Name); err != nil {
+					a.Logger.WithError(err).Errorf("無法取得 %s 套餐 %s 的選項 %s", restaurant.Name, item.Name, name)
+					return err
+				}
+				if option.IsCombo() {
+					return fmt.Errorf("option %s of combo %s is a combo", name, item.Name)
+				}
+			}
+			comboSlot.Options = append(comboSlot.Options, option)
+		}
+		slots = append(slots, comboSlot)
+	}
+	if err := a.MenuItemRepo.SetComboSlots(menuItems[item.Name].ID, slots); err != nil {
+		a.Logger.WithError(err).Errorf("無法設定 %s 套餐 %s 的選項", restaurant.Name, item.Name)
+		return err
+	}
+	return nil
+}
+
+// importAliases adds the aliases of a MenuFile that the restaurant does not have yet.
+func (a *AppHandler) importAliases(restaurantID uint, file *MenuFile) error {
+	restaurant, err := a.RestaurantRepo.GetRestaurantByID(restaurantID)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 %s 餐廳資訊", file.Name)
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, alias := range restaurant.Aliases {
+		existing[alias.Name] = true
+	}
+	for _, alias := range file.Aliases {
+		if existing[alias] {
+			continue
+		}
+		if err := a.RestaurantRepo.AddRestaurantAlias(&models.RestaurantAlias{RestaurantID: restaurantID, Name: alias}); err != nil {
+			a.Logger.WithError(err).Errorf("無法匯入 %s 的別名 %s", file.Name, alias)
+			return err
+		}
+		existing[alias] = true
+	}
+	return nil
+}
@@ -23,6 +23,11 @@ type AppHandler struct {
 	OrderRepo       models.OrderRepository
 	OrderDetailRepo models.OrderDetailRepository
 	RestaurantRepo  models.RestaurantRepository
+	RatingRepo      models.RatingRepository
+
+	imageUploads pendingImages
+	orderEvents  orderEvents
+	displayNames displayNames
 }
 
 func NewAppHandler(log *logrus.Logger, templates *TemplateHandler, config *config.Config, bot *linebot.Client, db *gorm.DB) (*AppHandler, error) {
@@ -40,6 +45,7 @@ func NewAppHandler(log *logrus.Logger, templates *TemplateHandler, config *confi
 		},
 		OrderRepo: &models.OrderGormRepository{
 			BaseRepository: baseRepo,
+			ReportLinkTTL:  config.ReportLinkTTL,
 		},
 		OrderDetailRepo: &models.OrderDetailGormRepository{
 			BaseRepository: baseRepo,
@@ -47,11 +53,18 @@ func NewAppHandler(log *logrus.Logger, templates *TemplateHandler, config *confi
 		RestaurantRepo: &models.RestaurantGormRepository{
 			BaseRepository: baseRepo,
 		},
+		RatingRepo: &models.RatingGormRepository{
+			BaseRepository: baseRepo,
+		},
 	}
 
 	if err := appHandler.initRepository(); err != nil {
 		return nil, err
 	}
+	// Reports are rebuilt with the display names of their participants, which the seed subcommand has no bot to look up
+	if bot != nil {
+		appHandler.migrateLegacyReports()
+	}
 
 	return appHandler, nil
 }
@@ -60,10 +73,12 @@ func (a *AppHandler) initRepository() error {
 	initRepos := []interface {
 		Init() error
 	}{
+		// Restaurants go first, as merging duplicate restaurants moves their menu items
+		a.RestaurantRepo,
 		a.MenuItemRepo,
 		a.OrderRepo,
 		a.OrderDetailRepo,
-		a.RestaurantRepo,
+		a.RatingRepo,
 	}
 
 	for _, initRepo := range initRepos {
@@ -74,3 +89,47 @@ func (a *AppHandler) initRepository() error {
 	}
 	return nil
 }
+
+// migrateLegacyReports rebuilds the reports stored as HTML from their order details, and drops the HTML once all of
+// them are rebuilt. Failures are logged and retried at the next start, as the reports are not needed to run.
+func (a *AppHandler) migrateLegacyReports() {
+	orderIDs, err := a.OrderRepo.GetOrderIDsWithLegacyReport()
+	if err != nil {
+		a.Logger.WithError(err).Error("無法取得舊版報表")
+		return
+	}
+	for _, orderID := range orderIDs {
+		order, err := a.OrderRepo.GetOrderByID(orderID)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單", orderID)
+			return
+		}
+		orderDetails, err := a.OrderDetailRepo.GetAllOrderDetailsByOrderID(orderID)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單細項", orderID)
+			return
+		}
+		// The report was last saved by 統計. Names that cannot be looked up now are kept in the HTML until the next start.
+		report, err := a.buildOrderReport(order, orderDetails, order.UpdatedAt, a.displayName)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單參與者名稱", orderID)
+			return
+		}
+		if err := a.OrderRepo.SaveLegacyReport(orderID, report); err != nil {
+			a.Logger.WithError(err).Errorf("無法重建 ID %d 的報表", orderID)
+			return
+		}
+	}
+	if len(orderIDs) > 0 {
+		a.Logger.Infof("已重建 %d 份舊版報表", len(orderIDs))
+	}
+	if err := a.OrderRepo.DropLegacyReports(); err != nil {
+		a.Logger.WithError(err).Error("無法移除舊版報表")
+	}
+}
+
+// publicURL returns the URL at which path on this server is reachable from the outside. PublicBaseURL is
+// validated by config.LoadEnvVariables and has no trailing slash.
+func (a *AppHandler) publicURL(path string) string {
+	return a.Config.PublicBaseURL + path
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// maxQuickReplyItems is the number of quick reply buttons LINE shows for a message.
+const maxQuickReplyItems = 13
+
+// choiceReplacer folds the fullwidth separators of combo slots and choices.
+var choiceReplacer = strings.NewReplacer("：", ":", "｜", "|")
+
+// handleNewCombo handles 加套餐/餐廳/套餐,價格/湯:玉米濃湯|味噌湯/飲料:紅茶|綠茶. Each slot is a required choice
+// from the listed menu items, given by name or code.
+func (a *AppHandler) handleNewCombo(args []string) (string, error) {
+	if len(args) < 3 || args[0] == "" {
+		return "", ErrInputError
+	}
+
+	restaurant, err := a.fetchRestaurant(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	itemArgs := strings.Split(args[1], ",")
+	if len(itemArgs) != 2 || itemArgs[0] == "" {
+		return "", ErrInputError
+	}
+	price, err := strconv.Atoi(itemArgs[1])
+	if err != nil {
+		return "", ErrInputError
+	}
+	combo := &models.MenuItem{Name: itemArgs[0], Price: price, RestaurantID: restaurant.ID, Restaurant: restaurant}
+
+	var slots []*models.ComboSlot
+	for _, slotSpec := range args[2:] {
+		slotName, optionSpecs, found := strings.Cut(choiceReplacer.Replace(slotSpec), ":")
+		slotName = strings.TrimSpace(slotName)
+		if !found || slotName == "" {
+			return "", ErrComboError
+		}
+		slot := &models.ComboSlot{Name: slotName}
+		for _, optionSpec := range strings.Split(optionSpecs, "|") {
+			if optionSpec = strings.TrimSpace(optionSpec); optionSpec == "" {
+				continue
+			}
+			option, err := a.fetchMenuItem(optionSpec, restaurant)
+			if err != nil {
+				return "", err
+			}
+			if option.Name == combo.Name || option.IsCombo() {
+				return "", ErrComboError
+			}
+			slot.Options = append(slot.Options, option)
+		}
+		if len(slot.Options) == 0 {
+			return "", ErrComboError
+		}
+		slots = append(slots, slot)
+	}
+
+	previous, err := a.MenuItemRepo.UpsertMenuItem(combo)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法新增 %s 套餐 %s", restaurant.Name, combo.Name)
+		return "", ErrNewMenuItemError
+	}
+	if err := a.MenuItemRepo.SetComboSlots(combo.ID, slots); err != nil {
+		a.Logger.WithError(err).Errorf("無法設定 %s 套餐 %s 的選項", restaurant.Name, combo.Name)
+		return "", ErrNewMenuItemError
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "增加套餐至 %s\n", restaurant.Name)
+	sb.WriteString(describeMenuItemUpsert(previous, combo))
+	for _, slot := range slots {
+		fmt.Fprintf(&sb, "%s: %s\n", slot.Name, strings.Join(optionNames(slot), "、"))
+	}
+	return sb.String(), nil
+}
+
+// splitChoices splits an ordered item such as "雞腿套餐:玉米濃湯:紅茶" into the item and the chosen components.
+func splitChoices(spec string) (string, []string) {
+	parts := strings.Split(choiceReplacer.Replace(spec), ":")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts[0], parts[1:]
+}
+
+// resolveChoices matches the choices for a combo against its slots, by code or name. When a slot has no valid choice
+// yet, a *ComboChoicesError prompting for it is returned.
+func resolveChoices(combo *models.MenuItem, choices []string, quantity int) ([]string, error) {
+	if len(choices) > len(combo.ComboSlots) {
+		return nil, ErrInputError
+	}
+
+	var chosen []string
+	for i, slot := range combo.ComboSlots {
+		var option *models.MenuItem
+		if i < len(choices) {
+			option = matchOption(choices[i], slot.Options)
+		}
+		if option == nil {
+			return nil, &ComboChoicesError{
+				Item:     strings.Join(append([]string{combo.Name}, chosen...), ":"),
+				Slot:     slot.Name,
+				Options:  optionNames(slot),
+				Quantity: quantity,
+			}
+		}
+		chosen = append(chosen, option.Name)
+	}
+	return chosen, nil
+}
+
+// matchOption finds the option of a slot meant by choice, given as its code or name.
+func matchOption(choice string, options []*models.MenuItem) *models.MenuItem {
+	if code, err := strconv.Atoi(choice); err == nil {
+		for _, option := range options {
+			if option.Code == code {
+				return option
+			}
+		}
+		return nil
+	}
+	option, _ := matchMenuItem(choice, options)
+	return option
+}
+
+// optionNames returns the names of the options of a slot.
+func optionNames(slot *models.ComboSlot) []string {
+	names := make([]string, len(slot.Options))
+	for i, option := range slot.Options {
+		names[i] = option.Name
+	}
+	return names
+}
+
+// replyComboChoices replies with quick replies for the options of a combo slot if err is a *ComboChoicesError, and
+// reports whether it did.
+func (a *AppHandler) replyComboChoices(event *linebot.Event, err error) bool {
+	var choicesErr *ComboChoicesError
+	if !errors.As(err, &choicesErr) {
+		return false
+	}
+
+	var buttons []*linebot.QuickReplyButton
+	for _, option := range choicesErr.Options {
+		if len(buttons) >= maxQuickReplyItems {
+			break
+		}
+		buttons = append(buttons, linebot.NewQuickReplyButton("", linebot.NewMessageAction(truncateLabel(option), choicesErr.Command(option))))
+	}
+
+	message := linebot.NewTextMessage(choicesErr.Error()).WithQuickReplies(linebot.NewQuickReplyItems(buttons...))
+	a.sendMessages(event, message)
+	return true
+}
+
+// truncateLabel shortens s to fit the 20 characters LINE allows in action labels.
+func truncateLabel(s string) string {
+	const maxLabelLength = 20
+	return truncateText(s, maxLabelLength)
+}
+
+// truncateText shortens s to at most max characters, ending with an ellipsis when it was cut.
+func truncateText(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveChoices(t *testing.T) {
+	combo := &models.MenuItem{
+		Name: "雞腿套餐",
+		ComboSlots: []*models.ComboSlot{
+			{Name: "湯", Options: []*models.MenuItem{{Code: 5, Name: "玉米濃湯"}, {Code: 6, Name: "味噌湯"}}},
+			{Name: "飲料", Options: []*models.MenuItem{{Code: 7, Name: "紅茶"}, {Code: 8, Name: "綠茶"}}},
+		},
+	}
+
+	t.Run("should resolve choices by name or code", func(t *testing.T) {
+		chosen, err := resolveChoices(combo, []string{"味噌湯", "7"}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"味噌湯", "紅茶"}, chosen)
+	})
+
+	t.Run("should prompt for the first missing choice", func(t *testing.T) {
+		_, err := resolveChoices(combo, []string{"玉米濃湯"}, 2)
+		var choicesErr *ComboChoicesError
+		assert.ErrorAs(t, err, &choicesErr)
+		assert.Equal(t, "飲料", choicesErr.Slot)
+		assert.Equal(t, []string{"紅茶", "綠茶"}, choicesErr.Options)
+
+		choicesErr.Rest = []string{"滷蛋"}
+		assert.Equal(t, "點/雞腿套餐:玉米濃湯:綠茶*2/滷蛋", choicesErr.Command("綠茶"))
+
+		choicesErr.Note = "去冰"
+		assert.Equal(t, "點/雞腿套餐:玉米濃湯:綠茶*2#去冰/滷蛋", choicesErr.Command("綠茶"))
+	})
+
+	t.Run("should prompt again for an invalid choice", func(t *testing.T) {
+		_, err := resolveChoices(combo, []string{"酸辣湯", "紅茶"}, 1)
+		var choicesErr *ComboChoicesError
+		assert.ErrorAs(t, err, &choicesErr)
+		assert.Equal(t, "湯", choicesErr.Slot)
+		assert.Equal(t, "點/雞腿套餐:味噌湯", choicesErr.Command("味噌湯"))
+	})
+
+	t.Run("should reject too many choices", func(t *testing.T) {
+		_, err := resolveChoices(combo, []string{"玉米濃湯", "紅茶", "綠茶"}, 1)
+		assert.Equal(t, ErrInputError, err)
+	})
+}
+
+func TestSplitChoices(t *testing.T) {
+	item, choices := splitChoices("雞腿套餐：玉米濃湯: 紅茶")
+	assert.Equal(t, "雞腿套餐", item)
+	assert.Equal(t, []string{"玉米濃湯", "紅茶"}, choices)
+
+	item, choices = splitChoices("雞腿飯")
+	assert.Equal(t, "雞腿飯", item)
+	assert.Empty(t, choices)
+}
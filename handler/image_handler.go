@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// imageUploadTTL is how long 設圖 and 菜單照 wait for image messages.
+const imageUploadTTL = 5 * time.Minute
+
+// menuPhotoSize and menuPhotoPreviewSize bound the longer side of uploaded menu photos and of their previews, which
+// are stored as JPEG. LINE only sends JPEG and PNG images of up to 10MB, with previews of up to 1MB.
+const (
+	menuPhotoSize        = 2048
+	menuPhotoPreviewSize = 240
+)
+
+// imageTarget is the restaurant or menu item an image sent by a user will be attached to.
+// Menu photo targets take any number of images until they expire.
+type imageTarget struct {
+	RestaurantID uint
+	MenuItemID   uint // 0 targets the restaurant itself
+	MenuPhoto    bool
+	Name         string
+	Expires      time.Time
+}
+
+// pendingImages keeps the image targets of users waiting to send an image. The zero value is ready to use.
+type pendingImages struct {
+	mu      sync.Mutex
+	targets map[string]imageTarget
+}
+
+func (p *pendingImages) set(userID string, target imageTarget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.targets == nil {
+		p.targets = make(map[string]imageTarget)
+	}
+	p.targets[userID] = target
+}
+
+// take removes and returns the unexpired image target of a user.
+func (p *pendingImages) take(userID string, now time.Time) (imageTarget, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	target, ok := p.targets[userID]
+	delete(p.targets, userID)
+	if !ok || now.After(target.Expires) {
+		return imageTarget{}, false
+	}
+	return target, true
+}
+
+// joinImageURL rejoins an image URL that splitCommand split into several arguments, e.g. "https:", "",
+// "example.com", "a.jpg", and returns the arguments before it with the URL, or "" if there is none.
+func joinImageURL(args []string) ([]string, string) {
+	for i, arg := range args {
+		if arg == "https:" {
+			return args[:i], strings.Join(args[i:], "/")
+		}
+	}
+	return args, ""
+}
+
+// handleSetImage handles 設圖/餐廳[/品項][/網址]. With an image URL the image is set directly; otherwise the next image
+// message of the user is attached.
+func (a *AppHandler) handleSetImage(args []string, ID string) (string, error) {
+	args, imageURL := joinImageURL(args)
+	if imageURL != "" {
+		if u, err := url.Parse(imageURL); err != nil || u.Host == "" {
+			return "", ErrImageURLError
+		}
+	}
+	if len(args) < 1 || len(args) > 2 || args[0] == "" {
+		return "", ErrInputError
+	}
+
+	restaurant, err := a.fetchRestaurant(args[0])
+	if err != nil {
+		return "", err
+	}
+	target := imageTarget{RestaurantID: restaurant.ID, Name: restaurant.Name}
+	if len(args) == 2 {
+		menuItem, err := a.fetchMenuItem(args[1], restaurant)
+		if err != nil {
+			return "", err
+		}
+		target.MenuItemID = menuItem.ID
+		target.Name = fmt.Sprintf("%s %s", restaurant.Name, menuItem.Name)
+	}
+
+	if imageURL != "" {
+		return a.setImage(target, imageURL, "")
+	}
+	return a.waitForImage(target, ID)
+}
+
+// handleMenuPhoto handles 菜單照/餐廳[/網址|清除]. Without an image URL, the images the user sends next are added
+// as photos of the paper menu.
+func (a *AppHandler) handleMenuPhoto(args []string, ID string) (string, error) {
+	args, imageURL := joinImageURL(args)
+	if imageURL != "" {
+		args = append(args, imageURL)
+	}
+	if len(args) < 1 || len(args) > 2 || args[0] == "" {
+		return "", ErrInputError
+	}
+
+	restaurant, err := a.fetchRestaurant(args[0])
+	if err != nil {
+		return "", err
+	}
+	target := imageTarget{RestaurantID: restaurant.ID, MenuPhoto: true, Name: restaurant.Name}
+
+	if len(args) == 1 {
+		return a.waitForImage(target, ID)
+	}
+	switch {
+	case args[1] == "清除":
+		if err := a.RestaurantRepo.DeleteMenuPhotos(restaurant.ID); err != nil {
+			a.Logger.WithError(err).Errorf("無法清除 %s 的菜單照片", restaurant.Name)
+			return "", ErrSystemError
+		}
+		return fmt.Sprintf("已清除 %s 的菜單照片", restaurant.Name), nil
+	case strings.HasPrefix(args[1], "https://"):
+		if u, err := url.Parse(args[1]); err != nil || u.Host == "" {
+			return "", ErrImageURLError
+		}
+		return a.setImage(target, args[1], "")
+	default:
+		return "", ErrInputError
+	}
+}
+
+// waitForImage makes the next image messages of the user go to target.
+func (a *AppHandler) waitForImage(target imageTarget, ID string) (string, error) {
+	if a.Config.UploadDir == "" {
+		return "", ErrUploadDisabled
+	}
+	target.Expires = time.Now().Add(imageUploadTTL)
+	a.imageUploads.set(ID, target)
+	if target.MenuPhoto {
+		return fmt.Sprintf("請在 %d 分鐘內傳送 %s 的菜單照片，可傳送多張", int(imageUploadTTL.Minutes()), target.Name), nil
+	}
+	return fmt.Sprintf("請在 %d 分鐘內傳送 %s 的圖片", int(imageUploadTTL.Minutes()), target.Name), nil
+}
+
+// handleImageMessage attaches an image message to the target the user chose with 設圖 or 菜單照. Images sent
+// without them are ignored and return an empty reply.
+func (a *AppHandler) handleImageMessage(message *linebot.ImageMessage, ID string) (string, error) {
+	target, ok := a.imageUploads.take(ID, time.Now())
+	if !ok {
+		return "", nil
+	}
+	if target.MenuPhoto {
+		a.imageUploads.set(ID, target)
+	}
+
+	var imageURL, previewURL string
+	var err error
+	if target.MenuPhoto {
+		imageURL, previewURL, err = a.storeMenuPhoto(message)
+	} else {
+		imageURL, err = a.storeImageMessage(message)
+	}
+	if err != nil {
+		a.Logger.WithError(err).WithField("User", a.getDisplayNameFromID(ID)).Errorf("無法儲存 %s 的圖片", target.Name)
+		return "", ErrSystemError
+	}
+	return a.setImage(target, imageURL, previewURL)
+}
+
+// storeImageMessage saves the content of an image message into the upload directory and returns its public URL.
+// Images hosted elsewhere are referenced by their original URL.
+func (a *AppHandler) storeImageMessage(message *linebot.ImageMessage) (string, error) {
+	if message.ContentProvider != nil && message.ContentProvider.Type == linebot.ContentProviderTypeExternal {
+		return message.ContentProvider.OriginalContentURL, nil
+	}
+
+	content, err := a.Bot.GetMessageContent(message.ID).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get content of message %s: %w", message.ID, err)
+	}
+	defer content.Content.Close()
+
+	fileName, err := newUploadFileName(content.ContentType)
+	if err != nil {
+		return "", err
+	}
+	path, err := a.saveUpload(fileName, content.Content)
+	if err != nil {
+		return "", err
+	}
+	return a.publicURL(path), nil
+}
+
+// storeMenuPhoto saves the content of an image message as a menu photo and its preview, and returns their public
+// URLs. Both are converted to JPEG, so that they can be sent back as image messages whatever was uploaded.
+func (a *AppHandler) storeMenuPhoto(message *linebot.ImageMessage) (string, string, error) {
+	if message.ContentProvider != nil && message.ContentProvider.Type == linebot.ContentProviderTypeExternal {
+		return message.ContentProvider.OriginalContentURL, message.ContentProvider.PreviewImageURL, nil
+	}
+
+	content, err := a.Bot.GetMessageContent(message.ID).Do()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get content of message %s: %w", message.ID, err)
+	}
+	defer content.Content.Close()
+
+	img, _, err := image.Decode(content.Content)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode content of message %s: %w", message.ID, err)
+	}
+	path, err := a.saveJPEG(fitImage(img, menuPhotoSize), 90)
+	if err != nil {
+		return "", "", err
+	}
+	previewPath, err := a.saveJPEG(fitImage(img, menuPhotoPreviewSize), 80)
+	if err != nil {
+		return "", "", err
+	}
+	return a.publicURL(path), a.publicURL(previewPath), nil
+}
+
+// fitImage scales an image down so that neither side is longer than size, on a white background as JPEG has no
+// transparency.
+func fitImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, (height*size+width-1)/width
+		} else {
+			width, height = (width*size+height-1)/height, size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// saveJPEG writes an image into the upload directory as JPEG and returns the URL path it is served from.
+func (a *AppHandler) saveJPEG(img image.Image, quality int) (string, error) {
+	fileName, err := newUploadFileName("image/jpeg")
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return "", fmt.Errorf("failed to encode %s: %w", fileName, err)
+	}
+	return a.saveUpload(fileName, &buf)
+}
+
+// saveUpload writes r into the upload directory and returns the URL path it is served from.
+func (a *AppHandler) saveUpload(fileName string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(a.Config.UploadDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	f, err := os.Create(filepath.Join(a.Config.UploadDir, fileName))
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload %s: %w", fileName, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return "", fmt.Errorf("failed to write upload %s: %w", fileName, err)
+	}
+	return "/uploads/" + fileName, nil
+}
+
+// newUploadFileName returns a random file name with the extension of the content type.
+func newUploadFileName(contentType string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate file name: %w", err)
+	}
+	ext := ".jpg"
+	switch contentType {
+	case "image/png":
+		ext = ".png"
+	case "image/gif":
+		ext = ".gif"
+	case "image/webp":
+		ext = ".webp"
+	}
+	return hex.EncodeToString(b) + ext, nil
+}
+
+// setImage saves the image URL of a restaurant or menu item, or adds it as a menu photo with its preview, and
+// returns the reply.
+func (a *AppHandler) setImage(target imageTarget, imageURL, previewURL string) (string, error) {
+	var err error
+	switch {
+	case target.MenuPhoto:
+		err = a.RestaurantRepo.AddMenuPhoto(&models.MenuPhoto{RestaurantID: target.RestaurantID, URL: imageURL, PreviewURL: previewURL})
+	case target.MenuItemID != 0:
+		err = a.MenuItemRepo.SetMenuItemImageURL(target.MenuItemID, imageURL)
+	default:
+		err = a.RestaurantRepo.SetRestaurantImageURL(target.RestaurantID, imageURL)
+	}
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法設定 %s 的圖片", target.Name)
+		return "", ErrSystemError
+	}
+	if target.MenuPhoto {
+		return fmt.Sprintf("已新增 %s 的菜單照片", target.Name), nil
+	}
+	return fmt.Sprintf("已設定 %s 的圖片", target.Name), nil
+}
+
+// menuItemBoxComponent renders a menu item row, with a thumbnail when the item has an image.
+func (a *AppHandler) menuItemBoxComponent(menuItem *models.MenuItem, displayName string) (linebot.BoxComponent, error) {
+	if menuItem.ImageURL != "" {
+		return a.Templates.generateBoxComponent("menuItemImageListBoxComponent", menuItem.ImageURL, menuItem.Code, displayName, menuItem.Price, menuItem.Name, menuItem.Name)
+	}
+	return a.Templates.generateBoxComponent("menuItemListBoxComponent", menuItem.Code, displayName, menuItem.Price, menuItem.Name, menuItem.Name)
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/config"
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+)
+
+func TestPendingImages(t *testing.T) {
+	var p pendingImages
+	now := time.Now()
+
+	_, ok := p.take("user", now)
+	assert.False(t, ok)
+
+	p.set("user", imageTarget{RestaurantID: 1, Expires: now.Add(time.Minute)})
+	target, ok := p.take("user", now)
+	assert.True(t, ok)
+	assert.Equal(t, uint(1), target.RestaurantID)
+
+	// A target can only be taken once
+	_, ok = p.take("user", now)
+	assert.False(t, ok)
+
+	p.set("user", imageTarget{RestaurantID: 1, Expires: now.Add(-time.Minute)})
+	_, ok = p.take("user", now)
+	assert.False(t, ok)
+}
+
+func TestHandleSetImage(t *testing.T) {
+	restaurant := &models.Restaurant{Model: gorm.Model{ID: 1}, Name: "validRestaurant"}
+	menuItem := &models.MenuItem{Model: gorm.Model{ID: 10}, Code: 1, Name: "雞腿飯"}
+
+	newAppHandler := func(uploadDir string) (*AppHandler, *MockRestaurantRepository, *MockMenuItemRepository) {
+		mockRestaurantRepo := &MockRestaurantRepository{}
+		mockMenuItemRepo := &MockMenuItemRepository{}
+		mockRestaurantRepo.On("GetRestaurantByName", "validRestaurant").Return(restaurant, nil)
+		mockMenuItemRepo.On("GetMenuItemByDetails", "雞腿飯", "validRestaurant").Return(menuItem, nil)
+		return &AppHandler{
+			Logger:         logrus.New(),
+			Config:         &config.Config{UploadDir: uploadDir},
+			RestaurantRepo: mockRestaurantRepo,
+			MenuItemRepo:   mockMenuItemRepo,
+		}, mockRestaurantRepo, mockMenuItemRepo
+	}
+
+	t.Run("should set an image URL directly", func(t *testing.T) {
+		appHandler, mockRestaurantRepo, _ := newAppHandler("")
+		mockRestaurantRepo.On("SetRestaurantImageURL", uint(1), "https://example.com/img/a.jpg").Return(nil)
+		_, args := splitCommand("設圖/validRestaurant/https://example.com/img/a.jpg")
+		_, err := appHandler.handleSetImage(args, "user")
+		assert.NoError(t, err)
+		mockRestaurantRepo.AssertExpectations(t)
+	})
+
+	t.Run("should set an image URL of a menu item directly", func(t *testing.T) {
+		appHandler, _, mockMenuItemRepo := newAppHandler("")
+		mockMenuItemRepo.On("SetMenuItemImageURL", uint(10), "https://example.com/b.jpg").Return(nil)
+		_, args := splitCommand("設圖/validRestaurant/雞腿飯/https://example.com/b.jpg")
+		_, err := appHandler.handleSetImage(args, "user")
+		assert.NoError(t, err)
+		mockMenuItemRepo.AssertExpectations(t)
+	})
+
+	t.Run("should require an upload directory to wait for an image", func(t *testing.T) {
+		appHandler, _, _ := newAppHandler("")
+		_, err := appHandler.handleSetImage([]string{"validRestaurant"}, "user")
+		assert.Equal(t, ErrUploadDisabled, err)
+	})
+
+	t.Run("should attach the next image to the menu item", func(t *testing.T) {
+		appHandler, _, mockMenuItemRepo := newAppHandler(t.TempDir())
+		_, err := appHandler.handleSetImage([]string{"validRestaurant", "雞腿飯"}, "user")
+		assert.NoError(t, err)
+
+		// Images of other users are ignored
+		rs, err := appHandler.handleImageMessage(&linebot.ImageMessage{ID: "1"}, "other")
+		assert.NoError(t, err)
+		assert.Empty(t, rs)
+
+		mockMenuItemRepo.On("SetMenuItemImageURL", uint(10), "https://example.com/b.jpg").Return(nil)
+		rs, err = appHandler.handleImageMessage(&linebot.ImageMessage{
+			ID: "2",
+			ContentProvider: &linebot.ContentProvider{
+				Type:               linebot.ContentProviderTypeExternal,
+				OriginalContentURL: "https://example.com/b.jpg",
+			},
+		}, "user")
+		assert.NoError(t, err)
+		assert.Contains(t, rs, "雞腿飯")
+		mockMenuItemRepo.AssertExpectations(t)
+	})
+}
+
+func TestHandleMenuPhoto(t *testing.T) {
+	restaurant := &models.Restaurant{Model: gorm.Model{ID: 1}, Name: "validRestaurant"}
+	mockRestaurantRepo := &MockRestaurantRepository{}
+	mockRestaurantRepo.On("GetRestaurantByName", "validRestaurant").Return(restaurant, nil)
+	appHandler := &AppHandler{
+		Logger:         logrus.New(),
+		Config:         &config.Config{UploadDir: t.TempDir()},
+		RestaurantRepo: mockRestaurantRepo,
+	}
+
+	_, err := appHandler.handleMenuPhoto([]string{"validRestaurant"}, "user")
+	assert.NoError(t, err)
+
+	// Several photos can be sent in a row
+	for _, photoURL := range []string{"https://example.com/1.jpg", "https://example.com/2.jpg"} {
+		mockRestaurantRepo.On("AddMenuPhoto", &models.MenuPhoto{RestaurantID: 1, URL: photoURL}).Return(nil).Once()
+		_, err := appHandler.handleImageMessage(&linebot.ImageMessage{
+			ContentProvider: &linebot.ContentProvider{
+				Type:               linebot.ContentProviderTypeExternal,
+				OriginalContentURL: photoURL,
+			},
+		}, "user")
+		assert.NoError(t, err)
+	}
+
+	mockRestaurantRepo.On("AddMenuPhoto", &models.MenuPhoto{RestaurantID: 1, URL: "https://example.com/menu/3.jpg"}).Return(nil).Once()
+	_, args := splitCommand("菜單照/validRestaurant/https://example.com/menu/3.jpg")
+	_, err = appHandler.handleMenuPhoto(args, "user")
+	assert.NoError(t, err)
+
+	mockRestaurantRepo.On("DeleteMenuPhotos", uint(1)).Return(nil)
+	_, err = appHandler.handleMenuPhoto([]string{"validRestaurant", "清除"}, "user")
+	assert.NoError(t, err)
+
+	mockRestaurantRepo.AssertExpectations(t)
+}
+
+func TestStoreMenuPhoto(t *testing.T) {
+	// A wide PNG with transparency, larger than LINE previews allow
+	upload := image.NewNRGBA(image.Rect(0, 0, 3000, 1000))
+	upload.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, upload)
+	}))
+	defer server.Close()
+	bot, err := linebot.New("secret", "token", linebot.WithEndpointBase(server.URL), linebot.WithEndpointBaseData(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadDir := t.TempDir()
+	mockRestaurantRepo := &MockRestaurantRepository{}
+	appHandler := &AppHandler{
+		Logger:         logrus.New(),
+		Config:         &config.Config{UploadDir: uploadDir, PublicBaseURL: "https://eats.example.com"},
+		Bot:            bot,
+		RestaurantRepo: mockRestaurantRepo,
+	}
+	var photo *models.MenuPhoto
+	mockRestaurantRepo.On("AddMenuPhoto", mock.Anything).Run(func(args mock.Arguments) {
+		photo = args.Get(0).(*models.MenuPhoto)
+	}).Return(nil)
+
+	appHandler.imageUploads.set("user", imageTarget{RestaurantID: 1, MenuPhoto: true, Name: "validRestaurant", Expires: time.Now().Add(time.Minute)})
+	_, err = appHandler.handleImageMessage(&linebot.ImageMessage{ID: "1"}, "user")
+	if !assert.NoError(t, err) || !assert.NotNil(t, photo) {
+		return
+	}
+
+	for _, tt := range []struct {
+		url           string
+		width, height int
+	}{
+		{photo.URL, menuPhotoSize, 683},
+		{photo.PreviewURL, menuPhotoPreviewSize, 80},
+	} {
+		fileName := strings.TrimPrefix(tt.url, "https://eats.example.com/uploads/")
+		assert.True(t, strings.HasSuffix(fileName, ".jpg"), tt.url)
+		f, err := os.Open(filepath.Join(uploadDir, fileName))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		defer f.Close()
+		img, err := jpeg.Decode(f)
+		if assert.NoError(t, err) {
+			assert.Equal(t, image.Rect(0, 0, tt.width, tt.height), img.Bounds())
+		}
+	}
+}
+
+func TestMenuPhotoMessages(t *testing.T) {
+	previewed := &models.MenuPhoto{URL: "https://eats.example.com/uploads/1.jpg", PreviewURL: "https://eats.example.com/uploads/2.jpg"}
+	linked := &models.MenuPhoto{URL: "https://example.com/menu.webp"}
+
+	messages := menuPhotoMessages([]*models.MenuPhoto{previewed, linked, previewed, previewed, linked}, 3)
+	if assert.Len(t, messages, 3) {
+		assert.Equal(t, linebot.NewImageMessage(previewed.URL, previewed.PreviewURL), messages[0])
+		assert.Equal(t, linebot.NewTextMessage("菜單照片：\nhttps://example.com/menu.webp\nhttps://example.com/menu.webp"), messages[2])
+	}
+
+	assert.Len(t, menuPhotoMessages([]*models.MenuPhoto{previewed, previewed, previewed}, 2), 2)
+	assert.Empty(t, menuPhotoMessages([]*models.MenuPhoto{linked}, 0))
+}
@@ -2,24 +2,103 @@ package handler
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/JohnsonYuanTW/NCAEats/models"
 	"github.com/gin-gonic/gin"
 	"github.com/line/line-bot-sdk-go/v7/linebot"
 	"gorm.io/gorm"
 )
 
 var (
-	ErrInputError         = errors.New("指令輸入錯誤，請重新輸入")
-	ErrSystemError        = errors.New("系統有誤，請重新輸入")
-	ErrRestaurantNotFound = errors.New("無此餐廳，請重新輸入")
-	ErrMenuItemNotFound   = errors.New("無此品項，請重新輸入")
-	ErrOrderInProgress    = errors.New("目前有正在進行中的訂單，請重新輸入")
-	ErrNoOrderInProgress  = errors.New("目前沒有正在進行中的訂單，請重新輸入")
-	ErrNewRestaurantError = errors.New("無法新增餐廳")
-	ErrNewMenuItemError   = errors.New("無法新增餐點")
+	ErrInputError          = errors.New("指令輸入錯誤，請重新輸入")
+	ErrSystemError         = errors.New("系統有誤，請重新輸入")
+	ErrRestaurantNotFound  = errors.New("無此餐廳，請重新輸入")
+	ErrMenuItemNotFound    = errors.New("無此品項，請重新輸入")
+	ErrOrderInProgress     = errors.New("目前有正在進行中的訂單，請重新輸入")
+	ErrNoOrderInProgress   = errors.New("目前沒有正在進行中的訂單，請重新輸入")
+	ErrNewRestaurantError  = errors.New("無法新增餐廳")
+	ErrNewMenuItemError    = errors.New("無法新增餐點")
+	ErrEditRestaurantError = errors.New("無法更新餐廳")
+	ErrOpeningHoursError   = errors.New("營業時間格式錯誤，例如 1-5 11:00-14:00;6 11:00-13:00")
+	ErrDeadlineError       = errors.New("截止時間有誤，例如 開/餐廳/11:30")
+	ErrRestaurantClosed    = errors.New("請改選其他餐廳")
+	ErrNewAliasError       = errors.New("無法新增別名，別名可能已被使用")
+	ErrAPIDisabled         = errors.New("尚未設定 API_TOKEN，無法使用此功能")
+	ErrNoRestaurantToPick  = errors.New("沒有符合條件且營業中的餐廳")
+	ErrNotParticipant      = errors.New("只有參與訂單的人可以評分")
+	ErrImageURLError       = errors.New("圖片網址有誤，請使用 https 網址")
+	ErrItemPriceRequired   = errors.New("無此品項，菜單外的品項請附上價格，例如 點/滷肉飯$40")
+	ErrItemOnMenu          = errors.New("菜單上已有此品項，請直接點餐，例如 點/雞腿飯")
+	ErrComboError          = errors.New("套餐格式錯誤，例如 加套餐/餐廳/雞腿套餐,120/湯:玉米濃湯|味噌湯/飲料:紅茶|綠茶")
+	ErrNoSearchResult      = errors.New("找不到符合的餐點")
+	ErrDateRangeError      = errors.New("日期格式錯誤，例如 對帳/2023-05-01/2023-05-31")
+	ErrReportNotFound      = errors.New("找不到此報表連結，連結可能已失效")
+	ErrUploadDisabled      = errors.New("尚未設定 UPLOAD_DIR，請改用圖片網址，例如 設圖/餐廳/https://...")
 )
 
+// maxReplyMessages is the number of messages LINE accepts in one reply.
+const maxReplyMessages = 5
+
+// maxAltTextLength is the number of characters LINE allows in the alternative text of a Flex message.
+const maxAltTextLength = 400
+
+// bareCommands are the commands that can be sent without a "/".
+var bareCommands = map[string]bool{
+	"抽": true,
+}
+
+// RestaurantCandidatesError is returned when a restaurant name matches several restaurants.
+type RestaurantCandidatesError struct {
+	Query      string
+	Candidates []*models.Restaurant
+}
+
+func (e *RestaurantCandidatesError) Error() string {
+	return fmt.Sprintf("有多間餐廳符合 %s，請重新輸入", e.Query)
+}
+
+// ComboChoicesError is returned when a combo is ordered without a valid choice for one of its slots.
+// Item is the combo with the choices made so far, and Rest the items ordered after it in the same command.
+type ComboChoicesError struct {
+	Item     string
+	Slot     string
+	Options  []string
+	Quantity int
+	Note     string
+	Rest     []string
+}
+
+func (e *ComboChoicesError) Error() string {
+	return fmt.Sprintf("請選擇 %s 的%s：%s", strings.SplitN(e.Item, ":", 2)[0], e.Slot, strings.Join(e.Options, "、"))
+}
+
+// Command returns the 點 command that orders the combo with option chosen for the slot.
+func (e *ComboChoicesError) Command(option string) string {
+	item := e.Item + ":" + option
+	if e.Quantity > 1 {
+		item += fmt.Sprintf("*%d", e.Quantity)
+	}
+	if e.Note != "" {
+		item += "#" + e.Note
+	}
+	return strings.Join(append([]string{"點", item}, e.Rest...), "/")
+}
+
+// MenuItemSuggestionsError is returned when a menu item cannot be found but similar items exist.
+type MenuItemSuggestionsError struct {
+	Query       string
+	Suggestions []string
+}
+
+func (e *MenuItemSuggestionsError) Error() string {
+	return fmt.Sprintf("找不到 %s，你是不是要：%s？", e.Query, strings.Join(e.Suggestions, "、"))
+}
+
 func (a *AppHandler) CallbackHandler(c *gin.Context) {
 	var err error
 	events, err := a.Bot.ParseRequest(c.Request)
@@ -35,25 +114,49 @@ func (a *AppHandler) CallbackHandler(c *gin.Context) {
 	}
 
 	for _, event := range events {
+		if event.Type == linebot.EventTypePostback {
+			if rs, err := a.handlePostback(event.Postback.Data, event.Source.UserID); err != nil {
+				a.sendReply(event, err.Error())
+			} else {
+				a.sendReply(event, rs)
+			}
+			continue
+		}
+
+		if image, ok := event.Message.(*linebot.ImageMessage); ok {
+			if rs, err := a.handleImageMessage(image, event.Source.UserID); err != nil {
+				a.sendReply(event, err.Error())
+			} else if rs != "" {
+				a.sendReply(event, rs)
+			}
+			continue
+		}
+
 		message, ok := event.Message.(*linebot.TextMessage)
-		if !ok || !strings.Contains(message.Text, "/") {
+		if !ok || !(strings.Contains(message.Text, "/") || bareCommands[message.Text]) {
 			continue
 		}
-		// This is a text message event and containing "/"
-		args := strings.Split(message.Text, "/")
-		command, args := args[0], args[1:]
+		// This is a text message event and containing "/" or a bare command
+		command, args := splitCommand(message.Text)
 		var replyString string
 		ID := event.Source.UserID
+		chatID := chatIDOf(event.Source)
 		switch command {
 		case "吃", "開":
-			if container, err := a.handleNewOrder(args, ID); err != nil {
+			if messages, err := a.handleNewOrder(args, ID, chatID); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
 				replyString = err.Error()
 			} else {
-				a.sendReply(event, "開單", container)
+				a.sendMessages(event, messages...)
 				continue
 			}
 		case "點":
 			if rs, err := a.handleNewOrderItem(args, ID); err != nil {
+				if a.replyComboChoices(event, err) {
+					continue
+				}
 				replyString = err.Error()
 			} else {
 				replyString = rs
@@ -64,8 +167,104 @@ func (a *AppHandler) CallbackHandler(c *gin.Context) {
 			} else {
 				replyString = rs
 			}
+		case "改餐廳":
+			if rs, err := a.handleEditRestaurant(args); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "別名":
+			if rs, err := a.handleNewAlias(args); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "匯出":
+			if rs, err := a.handleExportMenu(args); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "標籤":
+			if rs, err := a.handleNewTags(args); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "抽":
+			if container, err := a.handlePickRestaurant(args, ID, chatID); err != nil {
+				replyString = err.Error()
+			} else {
+				a.sendReply(event, "抽餐廳", container)
+				continue
+			}
+		case "到貨":
+			if container, err := a.handleRequestRatings(args, ID); err != nil {
+				replyString = err.Error()
+			} else {
+				a.sendReply(event, "評分", container)
+				continue
+			}
+		case "設圖":
+			if rs, err := a.handleSetImage(args, ID); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "菜單照":
+			if rs, err := a.handleMenuPhoto(args, ID); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "加套餐":
+			if rs, err := a.handleNewCombo(args); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "找":
+			if container, err := a.handleSearchMenuItems(args); err != nil {
+				replyString = err.Error()
+			} else {
+				a.sendReply(event, "搜尋結果", container)
+				continue
+			}
+		case "公休":
+			if rs, err := a.handleNewClosure(args); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
 		case "加餐點":
 			if rs, err := a.handleNewMenuItem(args); err != nil {
+				if a.replyRestaurantCandidates(event, command, args, err) {
+					continue
+				}
 				replyString = err.Error()
 			} else {
 				replyString = rs
@@ -86,7 +285,20 @@ func (a *AppHandler) CallbackHandler(c *gin.Context) {
 				replyString = rs
 			}
 		case "統計":
-			if rs, err := a.handleStatistic(args, ID); err != nil {
+			if messages, err := a.handleStatistic(args, ID); err != nil {
+				replyString = err.Error()
+			} else {
+				a.sendMessages(event, messages...)
+				continue
+			}
+		case "對帳":
+			if rs, err := a.handleExportReports(args, chatID); err != nil {
+				replyString = err.Error()
+			} else {
+				replyString = rs
+			}
+		case "撤銷":
+			if rs, err := a.handleRevokeReport(args, ID, chatID); err != nil {
 				replyString = err.Error()
 			} else {
 				replyString = rs
@@ -106,13 +318,136 @@ func (a *AppHandler) CallbackHandler(c *gin.Context) {
 	}
 }
 
+// splitCommand splits a text message into its command and arguments on "/". URLs in it are split too; see
+// joinImageURL.
+func splitCommand(text string) (string, []string) {
+	args := strings.Split(text, "/")
+	return args[0], args[1:]
+}
+
+// chatIDOf returns the ID of the group, room or one-on-one chat an event comes from.
+func chatIDOf(source *linebot.EventSource) string {
+	switch source.Type {
+	case linebot.EventSourceTypeGroup:
+		return source.GroupID
+	case linebot.EventSourceTypeRoom:
+		return source.RoomID
+	default:
+		return source.UserID
+	}
+}
+
+// handlePostback handles the data of a postback event, which is encoded as a URL query with an "action" key.
+func (a *AppHandler) handlePostback(data string, ID string) (string, error) {
+	values, err := url.ParseQuery(data)
+	if err != nil {
+		return "", ErrInputError
+	}
+
+	switch values.Get("action") {
+	case "rate":
+		return a.handleRating(values, ID)
+	default:
+		return "", ErrInputError
+	}
+}
+
+// replyRestaurantCandidates replies with the candidates of a *RestaurantCandidatesError, each of which repeats
+// the command with the restaurant name in args[0] replaced when tapped. It reports whether a reply was sent.
+func (a *AppHandler) replyRestaurantCandidates(event *linebot.Event, command string, args []string, err error) bool {
+	var candidatesErr *RestaurantCandidatesError
+	if !errors.As(err, &candidatesErr) {
+		return false
+	}
+
+	container, err := a.Templates.generateFlexContainer("restaurantCandidateFlexContainer", candidatesErr.Query)
+	if err != nil {
+		a.Logger.WithError(err).Error("無法解析 restaurantCandidateFlexContainer")
+		return false
+	}
+	bubbleContainer, ok := container.(*linebot.BubbleContainer)
+	if !ok {
+		return false
+	}
+
+	for _, restaurant := range candidatesErr.Candidates {
+		text := strings.Join(append([]string{command, restaurant.Name}, args[1:]...), "/")
+		box, err := a.Templates.generateBoxComponent("restaurantCandidateBoxComponent", restaurant.Name, restaurant.Tel, restaurant.Name, text)
+		if err != nil {
+			a.Logger.WithError(err).Error("無法解析 restaurantCandidateBoxComponent")
+			return false
+		}
+		bubbleContainer.Body.Contents = append(bubbleContainer.Body.Contents, &box)
+	}
+
+	a.sendReply(event, "選擇餐廳", container)
+	return true
+}
+
 func (a *AppHandler) getDisplayNameFromID(userID string) string {
-	res, err := a.Bot.GetProfile(userID).Do()
+	name, err := a.displayName(userID)
 	if err != nil {
 		a.Logger.WithError(err).WithField("User", userID).Error("無法取得使用者 ID，請使用者加入好友")
 		return userID
 	}
-	return res.DisplayName
+	return name
+}
+
+// displayName looks up the LINE display name of a user. Lookups are cached for displayNameTTL, failed ones included,
+// as reports and live order pages show the name of every participant each time they are loaded.
+func (a *AppHandler) displayName(userID string) (string, error) {
+	now := time.Now()
+	if cached, ok := a.displayNames.get(userID, now); ok {
+		return cached.name, cached.err
+	}
+	cached := cachedName{expires: now.Add(displayNameTTL)}
+	res, err := a.Bot.GetProfile(userID).Do()
+	if err != nil {
+		cached.err = err
+	} else {
+		cached.name = res.DisplayName
+	}
+	a.displayNames.set(userID, cached)
+	return cached.name, cached.err
+}
+
+// displayNameTTL is how long display names are cached, and so how long a renamed participant keeps the old name.
+const displayNameTTL = 10 * time.Minute
+
+// displayNames caches the display name lookups of users. The zero value is ready to use.
+type displayNames struct {
+	mu    sync.Mutex
+	names map[string]cachedName
+}
+
+type cachedName struct {
+	name    string
+	err     error
+	expires time.Time
+}
+
+func (d *displayNames) set(userID string, name cachedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.names == nil {
+		d.names = make(map[string]cachedName)
+	}
+	d.names[userID] = name
+}
+
+// get returns the unexpired lookup of a user, dropping it once expired.
+func (d *displayNames) get(userID string, now time.Time) (cachedName, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name, ok := d.names[userID]
+	if !ok {
+		return cachedName{}, false
+	}
+	if now.After(name.expires) {
+		delete(d.names, userID)
+		return cachedName{}, false
+	}
+	return name, true
 }
 
 func (a *AppHandler) sendReply(event *linebot.Event, msg ...interface{}) {
@@ -145,3 +480,10 @@ func (a *AppHandler) sendReply(event *linebot.Event, msg ...interface{}) {
 		a.Logger.WithError(err).Error("無法傳送回覆")
 	}
 }
+
+// sendMessages replies with several messages at once.
+func (a *AppHandler) sendMessages(event *linebot.Event, messages ...linebot.SendingMessage) {
+	if _, err := a.Bot.ReplyMessage(event.ReplyToken, messages...).Do(); err != nil {
+		a.Logger.WithError(err).Error("無法傳送回覆")
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/gin-gonic/gin"
+)
+
+// liveKeepAlive is how often an idle live order stream sends a comment, so that proxies keep it open.
+const liveKeepAlive = 30 * time.Second
+
+// orderEvents fans out changes of orders to the live order pages watching them. Changes are only signalled; the
+// pages reload the order themselves, so a slow page misses nothing but intermediate states. The zero value is
+// ready to use.
+type orderEvents struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan struct{}]bool
+}
+
+// subscribe returns a channel signalled whenever the order changes, and a function to stop the subscription.
+func (e *orderEvents) subscribe(orderID uint) (<-chan struct{}, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subscribers == nil {
+		e.subscribers = make(map[uint]map[chan struct{}]bool)
+	}
+	if e.subscribers[orderID] == nil {
+		e.subscribers[orderID] = make(map[chan struct{}]bool)
+	}
+	ch := make(chan struct{}, 1)
+	e.subscribers[orderID][ch] = true
+
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subscribers[orderID], ch)
+		if len(e.subscribers[orderID]) == 0 {
+			delete(e.subscribers, orderID)
+		}
+	}
+}
+
+// publish signals the subscribers of an order that it changed, without waiting for them.
+func (e *orderEvents) publish(orderID uint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subscribers[orderID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A signal is already pending
+		}
+	}
+}
+
+// liveOrder is the state of an order shown on its live page, sent as JSON to update it.
+type liveOrder struct {
+	*userReportPage
+	Deadline string `json:"deadline,omitempty"`
+	Closed   bool   `json:"closed"`
+}
+
+// loadLiveOrder builds the current state of an order. Cleared orders are closed and show what was ordered.
+func (a *AppHandler) loadLiveOrder(orderID uint) (*liveOrder, error) {
+	order, err := a.OrderRepo.GetOrderByID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	closed := order.DeletedAt.Valid
+
+	var orderDetails []*models.OrderDetail
+	if closed {
+		orderDetails, err = a.OrderDetailRepo.GetAllOrderDetailsByOrderID(orderID)
+	} else {
+		orderDetails, err = a.OrderDetailRepo.GetActiveOrderDetailsByOrderID(orderID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	live := &liveOrder{
+		userReportPage: newUserReportPage(a.newOrderReport(order, orderDetails, time.Now())),
+		Closed:         closed,
+	}
+	live.ReportID = order.ReportID
+	if order.Deadline != nil {
+		live.Deadline = order.Deadline.In(reportLocation).Format("15:04")
+	}
+	return live, nil
+}
+
+// lookupLiveOrder finds the order of the report ID in the request path, replying with an error if it fails.
+func (a *AppHandler) lookupLiveOrder(c *gin.Context) (uint, bool) {
+	reportID := c.Param("reportID")
+	orderID, err := a.OrderRepo.GetOrderIDByReportID(reportID)
+	if err != nil {
+		c.String(http.StatusNotFound, "Order not found")
+		a.Logger.WithError(err).Errorf("無法取得 %s 即時訂單", reportID)
+		return 0, false
+	}
+	return orderID, true
+}
+
+// LiveOrderHandler serves the live page of an order, which follows its changes from LiveOrderEventsHandler.
+func (a *AppHandler) LiveOrderHandler(c *gin.Context) {
+	orderID, ok := a.lookupLiveOrder(c)
+	if !ok {
+		return
+	}
+	live, err := a.loadLiveOrder(orderID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Could not load order")
+		a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單", orderID)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := a.Templates.renderHTML(&buf, "liveOrder.html", live); err != nil {
+		c.String(http.StatusInternalServerError, "Could not render order")
+		a.Logger.WithError(err).Errorf("無法產生 ID %d 的即時訂單頁面", orderID)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// LiveOrderEventsHandler streams the state of an order as server-sent "order" events: once on connecting and
+// again whenever it changes, until the order is cleared, its link is revoked or the client goes away.
+func (a *AppHandler) LiveOrderEventsHandler(c *gin.Context) {
+	orderID, ok := a.lookupLiveOrder(c)
+	if !ok {
+		return
+	}
+	changes, unsubscribe := a.orderEvents.subscribe(orderID)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+
+	// send reports whether to keep streaming
+	send := func() bool {
+		live, err := a.loadLiveOrder(orderID)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單", orderID)
+			return false
+		}
+		if live.ReportID != c.Param("reportID") {
+			// The link was revoked
+			return false
+		}
+		c.SSEvent("order", live)
+		return !live.Closed
+	}
+
+	first := true
+	c.Stream(func(w io.Writer) bool {
+		if first {
+			first = false
+			return send()
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-changes:
+			return send()
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		}
+	})
+}
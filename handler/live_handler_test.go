@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/config"
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/gin-gonic/gin"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestOrderEvents(t *testing.T) {
+	var events orderEvents
+	changes, unsubscribe := events.subscribe(1)
+	other, unsubscribeOther := events.subscribe(2)
+	defer unsubscribeOther()
+
+	// Changes not yet seen are coalesced
+	events.publish(1)
+	events.publish(1)
+	assert.Len(t, changes, 1)
+	assert.Len(t, other, 0)
+	<-changes
+
+	unsubscribe()
+	events.publish(1)
+	assert.Len(t, changes, 0)
+	assert.NotContains(t, events.subscribers, uint(1))
+}
+
+// newProfileBot returns a bot whose profiles all have the display name of their user ID.
+func newProfileBot(t *testing.T) *linebot.Client {
+	return newBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimPrefix(r.URL.Path, "/v2/bot/profile/")
+		json.NewEncoder(w).Encode(map[string]string{"userId": userID, "displayName": userID})
+	}))
+}
+
+// newBot returns a bot calling the LINE API served by handler.
+func newBot(t *testing.T, handler http.Handler) *linebot.Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	bot, err := linebot.New("secret", "token", linebot.WithEndpointBase(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+func TestDisplayName(t *testing.T) {
+	lookups := make(map[string]int)
+	appHandler := &AppHandler{
+		Logger: logrus.New(),
+		Bot: newBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID := strings.TrimPrefix(r.URL.Path, "/v2/bot/profile/")
+			lookups[userID]++
+			if userID == "blocked" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"userId": userID, "displayName": "小明"})
+		})),
+	}
+
+	for i := 0; i < 2; i++ {
+		name, err := appHandler.displayName("U1")
+		assert.NoError(t, err)
+		assert.Equal(t, "小明", name)
+		assert.Equal(t, "blocked", appHandler.getDisplayNameFromID("blocked"))
+	}
+	assert.Equal(t, map[string]int{"U1": 1, "blocked": 1}, lookups)
+	_, err := appHandler.displayName("blocked")
+	assert.Error(t, err)
+
+	// Expired lookups are made again
+	appHandler.displayNames.set("U1", cachedName{name: "小明", expires: time.Now().Add(-time.Second)})
+	_, err = appHandler.displayName("U1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, lookups["U1"])
+}
+
+func TestLiveOrderHandler(t *testing.T) {
+	var (
+		mockOrderRepo       MockOrderRepository
+		mockOrderDetailRepo MockOrderDetailRepository
+	)
+	appHandler := &AppHandler{
+		Config:          &config.Config{},
+		Logger:          logrus.New(),
+		Templates:       loadTemplates(t),
+		Bot:             newProfileBot(t),
+		OrderRepo:       &mockOrderRepo,
+		OrderDetailRepo: &mockOrderDetailRepo,
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/live/:reportID", appHandler.LiveOrderHandler)
+	r.GET("/live/:reportID/events", appHandler.LiveOrderEventsHandler)
+
+	deadline := time.Date(2023, 5, 1, 4, 30, 0, 0, time.UTC)
+	order := &models.Order{
+		Model:      gorm.Model{ID: 7},
+		ReportID:   "abc123",
+		Deadline:   &deadline,
+		Restaurant: &models.Restaurant{Name: "悟饕池上飯包"},
+	}
+	details := []*models.OrderDetail{
+		{Owner: "<script>alert(1)</script>", ItemName: "排骨飯", Note: "不要辣", Quantity: 2, UnitPrice: 100},
+	}
+	mockOrderRepo.On("GetOrderIDByReportID", "abc123").Return(uint(7), nil)
+	mockOrderRepo.On("GetOrderIDByReportID", "missing").Return(uint(0), gorm.ErrRecordNotFound)
+
+	t.Run("should render the current order with display names escaped", func(t *testing.T) {
+		mockOrderRepo.On("GetOrderByID", uint(7)).Return(order, nil).Once()
+		mockOrderDetailRepo.On("GetActiveOrderDetailsByOrderID", uint(7)).Return(details, nil).Once()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/live/abc123", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		assert.NotContains(t, body, "<script>alert(1)</script>")
+		assert.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+		assert.Contains(t, body, "截止時間：12:30")
+		assert.Contains(t, body, "備註：不要辣")
+		assert.Contains(t, body, "EventSource")
+	})
+
+	t.Run("should render a cleared order without following it", func(t *testing.T) {
+		cleared := *order
+		cleared.DeletedAt = gorm.DeletedAt{Time: deadline, Valid: true}
+		mockOrderRepo.On("GetOrderByID", uint(7)).Return(&cleared, nil).Once()
+		mockOrderDetailRepo.On("GetAllOrderDetailsByOrderID", uint(7)).Return(details, nil).Once()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/live/abc123", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		assert.Contains(t, body, "訂單已結束")
+		assert.Contains(t, body, "排骨飯")
+		assert.NotContains(t, body, "EventSource")
+	})
+
+	t.Run("should respond not found for unknown orders", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/live/missing", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should stream changes until the order is cleared", func(t *testing.T) {
+		cleared := *order
+		cleared.DeletedAt = gorm.DeletedAt{Time: deadline, Valid: true}
+		mockOrderRepo.On("GetOrderByID", uint(7)).Return(order, nil).Once()
+		mockOrderRepo.On("GetOrderByID", uint(7)).Return(&cleared, nil).Once()
+		mockOrderDetailRepo.On("GetActiveOrderDetailsByOrderID", uint(7)).Return([]*models.OrderDetail{}, nil).Once()
+		mockOrderDetailRepo.On("GetAllOrderDetailsByOrderID", uint(7)).Return(details, nil).Once()
+
+		server := httptest.NewServer(r)
+		defer server.Close()
+		res, err := http.Get(server.URL + "/live/abc123/events")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+		body := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(res.Body)
+			body <- string(b)
+		}()
+
+		// Clear the order once the stream is subscribed to it
+		assert.Eventually(t, func() bool {
+			appHandler.orderEvents.mu.Lock()
+			defer appHandler.orderEvents.mu.Unlock()
+			return len(appHandler.orderEvents.subscribers[7]) == 1
+		}, time.Second, time.Millisecond)
+		appHandler.orderEvents.publish(7)
+
+		var stream string
+		select {
+		case stream = <-body:
+		case <-time.After(time.Second):
+			t.Fatal("stream did not end after the order was cleared")
+		}
+		events := strings.Split(strings.TrimSpace(stream), "\n\n")
+		if assert.Len(t, events, 2) {
+			assert.Contains(t, events[0], `"total":0`)
+			assert.Contains(t, events[0], `"closed":false`)
+			assert.Contains(t, events[1], `"closed":true`)
+			assert.Contains(t, events[1], `"item":"排骨飯"`)
+		}
+		assert.Eventually(t, func() bool {
+			appHandler.orderEvents.mu.Lock()
+			defer appHandler.orderEvents.mu.Unlock()
+			return len(appHandler.orderEvents.subscribers) == 0
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("should end the stream of a revoked link", func(t *testing.T) {
+		revoked := *order
+		revoked.ReportID = "def456"
+		mockOrderRepo.On("GetOrderByID", uint(7)).Return(&revoked, nil).Once()
+		mockOrderDetailRepo.On("GetActiveOrderDetailsByOrderID", uint(7)).Return([]*models.OrderDetail{}, nil).Once()
+
+		server := httptest.NewServer(r)
+		defer server.Close()
+		res, err := http.Get(server.URL + "/live/abc123/events")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Empty(t, b)
+	})
+}
@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+)
+
+// MenuFile is the exchange format of a restaurant and its menu, shared by menu exports, imports and seed files.
+// OpeningHours uses the same format as the 改餐廳 command, e.g. "1-5 11:00-14:00;6 11:00-13:00".
+type MenuFile struct {
+	Name         string          `json:"name" yaml:"name"`
+	Tel          string          `json:"tel,omitempty" yaml:"tel,omitempty"`
+	Address      string          `json:"address,omitempty" yaml:"address,omitempty"`
+	OpeningHours string          `json:"openingHours,omitempty" yaml:"openingHours,omitempty"`
+	MinimumOrder int             `json:"minimumOrder,omitempty" yaml:"minimumOrder,omitempty"`
+	DeliveryFee  int             `json:"deliveryFee,omitempty" yaml:"deliveryFee,omitempty"`
+	ServiceMode  string          `json:"serviceMode,omitempty" yaml:"serviceMode,omitempty"`
+	Notes        string          `json:"notes,omitempty" yaml:"notes,omitempty"`
+	Aliases      []string        `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	Tags         []string        `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Items        []*MenuFileItem `json:"items" yaml:"items"`
+}
+
+// MenuFileItem is a single menu item in a MenuFile. Combos list their choice slots, whose options are the names of
+// other items of the restaurant.
+type MenuFileItem struct {
+	Code  int             `json:"code,omitempty" yaml:"code,omitempty"`
+	Name  string          `json:"name" yaml:"name"`
+	Price int             `json:"price" yaml:"price"`
+	Slots []*MenuFileSlot `json:"slots,omitempty" yaml:"slots,omitempty"`
+}
+
+// MenuFileSlot is a choice slot of a combo in a MenuFile.
+type MenuFileSlot struct {
+	Name    string   `json:"name" yaml:"name"`
+	Options []string `json:"options" yaml:"options"`
+}
+
+// menuCSVHeader lists the columns of a menu CSV. Each row is one menu item, repeating its restaurant's profile.
+// Aliases, tags and slot options are separated by |, and slots by /, as in 加套餐, e.g. 湯:玉米濃湯|味噌湯/飲料:紅茶.
+var menuCSVHeader = []string{"restaurant", "tel", "address", "opening_hours", "minimum_order", "delivery_fee", "service_mode", "notes", "aliases", "tags", "code", "item", "price", "slots"}
+
+// utf8BOM lets spreadsheet programs detect that a CSV is encoded in UTF-8.
+const utf8BOM = "\uFEFF"
+
+// newMenuFile converts a restaurant and its menu items into a MenuFile.
+func newMenuFile(restaurant *models.Restaurant) *MenuFile {
+	file := &MenuFile{
+		Name:         restaurant.Name,
+		Tel:          restaurant.Tel,
+		Address:      restaurant.Address,
+		OpeningHours: formatOpeningHoursSpec(restaurant.OpeningHours),
+		MinimumOrder: restaurant.MinimumOrder,
+		DeliveryFee:  restaurant.DeliveryFee,
+		ServiceMode:  string(restaurant.ServiceMode),
+		Notes:        restaurant.Notes,
+		Items:        []*MenuFileItem{},
+	}
+	for _, alias := range restaurant.Aliases {
+		file.Aliases = append(file.Aliases, alias.Name)
+	}
+	for _, tag := range restaurant.Tags {
+		file.Tags = append(file.Tags, tag.Name)
+	}
+	for _, menuItem := range restaurant.MenuItems {
+		item := &MenuFileItem{Code: menuItem.Code, Name: menuItem.Name, Price: menuItem.Price}
+		for _, comboSlot := range menuItem.ComboSlots {
+			slot := &MenuFileSlot{Name: comboSlot.Name}
+			for _, option := range comboSlot.Options {
+				slot.Options = append(slot.Options, option.Name)
+			}
+			item.Slots = append(item.Slots, slot)
+		}
+		file.Items = append(file.Items, item)
+	}
+	return file
+}
+
+// validate checks that a MenuFile can be imported.
+func (f *MenuFile) validate() error {
+	if strings.TrimSpace(f.Name) == "" {
+		return errors.New("restaurant name is required")
+	}
+	if _, err := parseOpeningHours(f.OpeningHours); err != nil {
+		return fmt.Errorf("restaurant %s: %w", f.Name, err)
+	}
+	switch models.ServiceMode(f.ServiceMode) {
+	case "", models.ServiceDelivery, models.ServicePickup:
+	default:
+		return fmt.Errorf("restaurant %s: invalid service mode %q", f.Name, f.ServiceMode)
+	}
+	if f.MinimumOrder < 0 || f.DeliveryFee < 0 {
+		return fmt.Errorf("restaurant %s: amounts must not be negative", f.Name)
+	}
+	for _, name := range append(append([]string{}, f.Aliases...), f.Tags...) {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("restaurant %s: aliases and tags must not be empty", f.Name)
+		}
+	}
+	combos := make(map[string]bool)
+	for _, item := range f.Items {
+		if strings.TrimSpace(item.Name) == "" {
+			return fmt.Errorf("restaurant %s: item name is required", f.Name)
+		}
+		if item.Price < 0 {
+			return fmt.Errorf("restaurant %s: price of %s must not be negative", f.Name, item.Name)
+		}
+		if item.Code < 0 {
+			return fmt.Errorf("restaurant %s: code of %s must not be negative", f.Name, item.Name)
+		}
+		combos[item.Name] = len(item.Slots) > 0
+	}
+	for _, item := range f.Items {
+		for _, slot := range item.Slots {
+			if strings.TrimSpace(slot.Name) == "" || len(slot.Options) == 0 {
+				return fmt.Errorf("restaurant %s: slots of %s need a name and options", f.Name, item.Name)
+			}
+			for _, option := range slot.Options {
+				if strings.TrimSpace(option) == "" || option == item.Name || combos[option] {
+					return fmt.Errorf("restaurant %s: invalid option %q of %s", f.Name, option, item.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// encodeMenuJSON writes a MenuFile as indented JSON.
+func encodeMenuJSON(w io.Writer, file *MenuFile) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(file)
+}
+
+// decodeMenuJSON reads either a single MenuFile or an array of them.
+func decodeMenuJSON(r io.Reader) ([]*MenuFile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*MenuFile
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &files)
+	} else {
+		file := &MenuFile{}
+		err = json.Unmarshal(trimmed, file)
+		files = []*MenuFile{file}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid menu JSON: %w", err)
+	}
+	return files, nil
+}
+
+// encodeMenuCSV writes MenuFiles as a CSV with one row per menu item. Restaurants without items get a row
+// with empty item columns so that their profile is kept.
+func encodeMenuCSV(w io.Writer, files ...*MenuFile) error {
+	if _, err := io.WriteString(w, utf8BOM); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(menuCSVHeader); err != nil {
+		return err
+	}
+	for _, file := range files {
+		profile := []string{
+			file.Name,
+			file.Tel,
+			file.Address,
+			file.OpeningHours,
+			strconv.Itoa(file.MinimumOrder),
+			strconv.Itoa(file.DeliveryFee),
+			file.ServiceMode,
+			file.Notes,
+			strings.Join(file.Aliases, "|"),
+			strings.Join(file.Tags, "|"),
+		}
+		if len(file.Items) == 0 {
+			if err := writer.Write(append(profile, "", "", "", "")); err != nil {
+				return err
+			}
+		}
+		for _, item := range file.Items {
+			row := append(append([]string{}, profile...), strconv.Itoa(item.Code), item.Name, strconv.Itoa(item.Price), formatSlotsSpec(item.Slots))
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// decodeMenuCSV reads MenuFiles from a CSV written by encodeMenuCSV, grouping rows by restaurant.
+// Columns are matched by the header, so they may be reordered and optional ones left out.
+func decodeMenuCSV(r io.Reader) ([]*MenuFile, error) {
+	reader := bufio.NewReader(r)
+	if bom, err := reader.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		reader.Discard(len(utf8BOM))
+	}
+
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid menu CSV: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("invalid menu CSV: missing header")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"restaurant", "item", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("invalid menu CSV: missing column %s", required)
+		}
+	}
+
+	var files []*MenuFile
+	byName := make(map[string]*MenuFile)
+	for line, record := range records[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(name string) (int, error) {
+			value := field(name)
+			if value == "" {
+				return 0, nil
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, fmt.Errorf("invalid menu CSV: line %d: invalid %s %q", line+2, name, value)
+			}
+			return n, nil
+		}
+
+		name := field("restaurant")
+		file, ok := byName[name]
+		if !ok {
+			file = &MenuFile{
+				Name:         name,
+				Tel:          field("tel"),
+				Address:      field("address"),
+				OpeningHours: field("opening_hours"),
+				ServiceMode:  field("service_mode"),
+				Notes:        field("notes"),
+				Aliases:      splitList(field("aliases")),
+				Tags:         splitList(field("tags")),
+				Items:        []*MenuFileItem{},
+			}
+			if file.MinimumOrder, err = number("minimum_order"); err != nil {
+				return nil, err
+			}
+			if file.DeliveryFee, err = number("delivery_fee"); err != nil {
+				return nil, err
+			}
+			byName[name] = file
+			files = append(files, file)
+		}
+
+		if field("item") == "" {
+			continue
+		}
+		item := &MenuFileItem{Name: field("item")}
+		if item.Code, err = number("code"); err != nil {
+			return nil, err
+		}
+		if item.Price, err = number("price"); err != nil {
+			return nil, err
+		}
+		if item.Slots, err = parseSlotsSpec(field("slots")); err != nil {
+			return nil, fmt.Errorf("invalid menu CSV: line %d: %w", line+2, err)
+		}
+		file.Items = append(file.Items, item)
+	}
+	return files, nil
+}
+
+// splitList splits a |-separated CSV cell, dropping empty entries.
+func splitList(cell string) []string {
+	var list []string
+	for _, entry := range strings.Split(cell, "|") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// formatSlotsSpec renders the slots of a combo in the format read by parseSlotsSpec.
+func formatSlotsSpec(slots []*MenuFileSlot) string {
+	specs := make([]string, len(slots))
+	for i, slot := range slots {
+		specs[i] = slot.Name + ":" + strings.Join(slot.Options, "|")
+	}
+	return strings.Join(specs, "/")
+}
+
+// parseSlotsSpec parses the slots of a combo, such as 湯:玉米濃湯|味噌湯/飲料:紅茶|綠茶.
+func parseSlotsSpec(spec string) ([]*MenuFileSlot, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var slots []*MenuFileSlot
+	for _, slotSpec := range strings.Split(choiceReplacer.Replace(spec), "/") {
+		name, options, found := strings.Cut(slotSpec, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid slot %q", slotSpec)
+		}
+		slots = append(slots, &MenuFileSlot{Name: strings.TrimSpace(name), Options: splitList(options)})
+	}
+	return slots, nil
+}
+
+// formatOpeningHoursSpec renders opening hours in the format read by parseOpeningHours.
+func formatOpeningHoursSpec(hours []*models.OpeningHour) string {
+	periods := make(map[time.Weekday][]string)
+	for _, h := range hours {
+		periods[h.Weekday] = append(periods[h.Weekday], h.Opens+"-"+h.Closes)
+	}
+
+	// Days are numbered from 1 (Monday) to 7 (Sunday)
+	dayPeriods := func(day int) string {
+		return strings.Join(periods[time.Weekday(day%7)], " ")
+	}
+	var specs []string
+	for i := 1; i <= 7; {
+		current := dayPeriods(i)
+		j := i + 1
+		for j <= 7 && dayPeriods(j) == current {
+			j++
+		}
+		if current != "" {
+			days := strconv.Itoa(i)
+			if j-i > 1 {
+				days += "-" + strconv.Itoa(j-1)
+			}
+			specs = append(specs, days+" "+current)
+		}
+		i = j
+	}
+	return strings.Join(specs, ";")
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/config"
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+)
+
+func testMenuFile(t *testing.T) *MenuFile {
+	openingHours, err := parseOpeningHours("1-5 11:00-14:00 17:00-20:00;6 11:00-13:00")
+	assert.NoError(t, err)
+	return newMenuFile(&models.Restaurant{
+		Name:         "池上便當",
+		Tel:          "02-1234-5678",
+		Address:      "台北市中正區, 忠孝東路一段 1 號",
+		OpeningHours: openingHours,
+		MinimumOrder: 300,
+		DeliveryFee:  30,
+		ServiceMode:  models.ServiceDelivery,
+		Notes:        "請提早\n一天 \"預訂\"",
+		Aliases:      []*models.RestaurantAlias{{Name: "池上"}, {Name: "便當店"}},
+		Tags:         []*models.Tag{{Name: "便當"}},
+		MenuItems: []*models.MenuItem{
+			{Code: 1, Name: "雞腿飯", Price: 100},
+			{Code: 2, Name: "排骨飯, 大", Price: 95},
+			{Code: 4, Name: "紅茶", Price: 20},
+			{Code: 5, Name: "便當套餐", Price: 110, ComboSlots: []*models.ComboSlot{
+				{Name: "主餐", Options: []*models.MenuItem{{Name: "雞腿飯"}, {Name: "排骨飯, 大"}}},
+				{Name: "飲料", Options: []*models.MenuItem{{Name: "紅茶"}}},
+			}},
+		},
+	})
+}
+
+func TestMenuFileRoundTrip(t *testing.T) {
+	file := testMenuFile(t)
+	assert.Equal(t, "1-5 11:00-14:00 17:00-20:00;6 11:00-13:00", file.OpeningHours)
+	assert.NoError(t, file.validate())
+
+	t.Run("csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, encodeMenuCSV(&buf, file))
+
+		files, err := decodeMenuCSV(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []*MenuFile{file}, files)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, encodeMenuJSON(&buf, file))
+
+		files, err := decodeMenuJSON(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []*MenuFile{file}, files)
+	})
+
+	t.Run("restaurant without items", func(t *testing.T) {
+		empty := &MenuFile{Name: "空的餐廳", Items: []*MenuFileItem{}}
+		var buf bytes.Buffer
+		assert.NoError(t, encodeMenuCSV(&buf, empty))
+
+		files, err := decodeMenuCSV(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []*MenuFile{empty}, files)
+	})
+}
+
+func TestImportExportedMenuFile(t *testing.T) {
+	mockRestaurantRepo := &MockRestaurantRepository{}
+	mockMenuItemRepo := &MockMenuItemRepository{}
+	appHandler := &AppHandler{
+		Logger:         logrus.New(),
+		RestaurantRepo: mockRestaurantRepo,
+		MenuItemRepo:   mockMenuItemRepo,
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, encodeMenuCSV(&buf, testMenuFile(t)))
+	files, err := decodeMenuCSV(&buf)
+	if !assert.NoError(t, err) || !assert.Len(t, files, 1) {
+		return
+	}
+
+	mockRestaurantRepo.On("UpsertRestaurant", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(*models.Restaurant).ID = 1
+	}).Return(nil, nil)
+	mockRestaurantRepo.On("SetOpeningHours", uint(1), mock.Anything).Return(nil)
+	mockRestaurantRepo.On("AddRestaurantTags", uint(1), []string{"便當"}).Return(nil)
+	mockRestaurantRepo.On("GetRestaurantByID", uint(1)).Return(&models.Restaurant{Model: gorm.Model{ID: 1}}, nil)
+	mockRestaurantRepo.On("AddRestaurantAlias", &models.RestaurantAlias{RestaurantID: 1, Name: "池上"}).Return(nil)
+	mockRestaurantRepo.On("AddRestaurantAlias", &models.RestaurantAlias{RestaurantID: 1, Name: "便當店"}).Return(nil)
+	menuItems := make(map[string]*models.MenuItem)
+	mockMenuItemRepo.On("UpsertMenuItem", mock.Anything).Run(func(args mock.Arguments) {
+		menuItem := args.Get(0).(*models.MenuItem)
+		menuItem.ID = uint(menuItem.Code) + 10
+		menuItems[menuItem.Name] = menuItem
+	}).Return(nil, nil)
+	mockMenuItemRepo.On("SetComboSlots", uint(15), mock.Anything).Return(nil)
+
+	_, err = appHandler.importMenuFile(files[0])
+	assert.NoError(t, err)
+	mockRestaurantRepo.AssertExpectations(t)
+	mockMenuItemRepo.AssertExpectations(t)
+
+	// Items keep their codes, and combos get their slots back
+	assert.Equal(t, 4, menuItems["紅茶"].Code)
+	assert.Equal(t, 110, menuItems["便當套餐"].Price)
+	slots := mockMenuItemRepo.Calls[len(mockMenuItemRepo.Calls)-1].Arguments.Get(1).([]*models.ComboSlot)
+	if assert.Len(t, slots, 2) {
+		assert.Equal(t, "主餐", slots[0].Name)
+		assert.Equal(t, []*models.MenuItem{menuItems["雞腿飯"], menuItems["排骨飯, 大"]}, slots[0].Options)
+		assert.Equal(t, []*models.MenuItem{menuItems["紅茶"]}, slots[1].Options)
+	}
+}
+
+func TestDecodeMenuCSV(t *testing.T) {
+	t.Run("columns in any order with several restaurants", func(t *testing.T) {
+		input := "item,price,restaurant\n雞腿飯,100,池上便當\n鍋貼,6,八方雲集\n排骨飯,95,池上便當\n"
+		files, err := decodeMenuCSV(bytes.NewBufferString(input))
+		assert.NoError(t, err)
+		if assert.Len(t, files, 2) {
+			assert.Equal(t, "池上便當", files[0].Name)
+			assert.Len(t, files[0].Items, 2)
+			assert.Equal(t, "八方雲集", files[1].Name)
+			assert.Len(t, files[1].Items, 1)
+		}
+	})
+
+	t.Run("missing required column", func(t *testing.T) {
+		_, err := decodeMenuCSV(bytes.NewBufferString("restaurant,item\n池上便當,雞腿飯\n"))
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid price", func(t *testing.T) {
+		_, err := decodeMenuCSV(bytes.NewBufferString("restaurant,item,price\n池上便當,雞腿飯,一百\n"))
+		assert.Error(t, err)
+	})
+
+	t.Run("slot without options", func(t *testing.T) {
+		_, err := decodeMenuCSV(bytes.NewBufferString("restaurant,item,price,slots\n池上便當,套餐,120,飲料\n"))
+		assert.Error(t, err)
+	})
+}
+
+func TestVerifySignature(t *testing.T) {
+	appHandler := &AppHandler{Config: &config.Config{APIToken: "secret", PublicBaseURL: "https://eats.example.com"}}
+	expires := time.Now().Add(time.Hour)
+	link, err := url.Parse(appHandler.signedURL("/api/chats/C1/reports.csv", expires, url.Values{"from": {"2023-05-01"}, "to": {"2023-05-31"}}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	query := link.Query()
+	assert.True(t, appHandler.verifySignature(link.Path, query))
+	assert.False(t, appHandler.verifySignature("/api/chats/C2/reports.csv", query), "other path")
+
+	changed := func(key, value string) url.Values {
+		changed := url.Values{}
+		for k, v := range query {
+			changed[k] = v
+		}
+		changed.Set(key, value)
+		return changed
+	}
+	assert.False(t, appHandler.verifySignature(link.Path, changed("from", "2023-01-01")), "other range")
+	assert.False(t, appHandler.verifySignature(link.Path, changed("chat", "C2")), "added parameter")
+	assert.False(t, appHandler.verifySignature(link.Path, changed("expires", strconv.FormatInt(expires.Unix()+1, 10))), "other expiry")
+
+	expired, err := url.Parse(appHandler.signedURL("/api/restaurants/1/menu.csv", time.Now().Add(-time.Minute), nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, appHandler.verifySignature(expired.Path, expired.Query()), "expired")
+}
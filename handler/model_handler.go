@@ -3,16 +3,20 @@ package handler
 import (
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/JohnsonYuanTW/NCAEats/models"
 	"github.com/line/line-bot-sdk-go/v7/linebot"
 	"gorm.io/gorm"
 )
 
-func (a *AppHandler) handleNewOrder(args []string, ID string) (linebot.FlexContainer, error) {
-	if len(args) != 1 || args[0] == "" {
+// handleNewOrder starts an order and returns the menu, followed by the photos of the paper menu if any.
+func (a *AppHandler) handleNewOrder(args []string, ID string, chatID string) ([]linebot.SendingMessage, error) {
+	if len(args) < 1 || len(args) > 2 || args[0] == "" {
 		return nil, ErrInputError
 	}
 
@@ -22,7 +26,20 @@ func (a *AppHandler) handleNewOrder(args []string, ID string) (linebot.FlexConta
 		return nil, err
 	}
 
-	menuItems, err := a.fetchMenuItems(restaurantName)
+	// The restaurant has to be open when the order is placed at its deadline
+	deadline := time.Now()
+	var orderDeadline *time.Time
+	if len(args) == 2 && args[1] != "" {
+		if deadline, err = parseDeadline(args[1], deadline); err != nil {
+			return nil, ErrDeadlineError
+		}
+		orderDeadline = &deadline
+	}
+	if err := a.checkRestaurantOpen(restaurant, deadline); err != nil {
+		return nil, err
+	}
+
+	menuItems, err := a.fetchMenuItems(restaurant.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -33,26 +50,109 @@ func (a *AppHandler) handleNewOrder(args []string, ID string) (linebot.FlexConta
 
 	newOrder := &models.Order{
 		Owner:      ID,
+		ChatID:     chatID,
+		Deadline:   orderDeadline,
 		Restaurant: restaurant,
 	}
 	if err = a.createOrder(newOrder); err != nil {
 		return nil, err
 	}
 
-	return a.generateMenuFlexContainer(restaurant, menuItems)
+	container, err := a.generateMenuFlexContainer(restaurant, menuItems, ID, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if newOrder.ReportID != "" {
+		footer, err := a.Templates.generateBoxComponent("liveOrderFooterBoxComponent", a.publicURL("/live/"+newOrder.ReportID))
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", "liveOrderFooterBoxComponent").Error("無法解析 JSON")
+			return nil, ErrSystemError
+		}
+		container.(*linebot.BubbleContainer).Footer = &footer
+	}
+	messages := []linebot.SendingMessage{linebot.NewFlexMessage("開單", container)}
+	return append(messages, menuPhotoMessages(restaurant.MenuPhotos, maxReplyMessages-len(messages))...), nil
+}
+
+// menuPhotoMessages sends up to limit messages of menu photos. LINE refuses a whole reply with an image it cannot
+// preview, so only photos with a preview are sent as images, and those given by URL are listed as links.
+func menuPhotoMessages(photos []*models.MenuPhoto, limit int) []linebot.SendingMessage {
+	var links []string
+	for _, photo := range photos {
+		if photo.PreviewURL == "" {
+			links = append(links, photo.URL)
+		}
+	}
+	if len(links) > 0 {
+		limit--
+	}
+
+	var messages []linebot.SendingMessage
+	for _, photo := range photos {
+		if photo.PreviewURL != "" && len(messages) < limit {
+			messages = append(messages, linebot.NewImageMessage(photo.URL, photo.PreviewURL))
+		}
+	}
+	if len(links) > 0 && limit >= 0 {
+		messages = append(messages, linebot.NewTextMessage("菜單照片：\n"+strings.Join(links, "\n")))
+	}
+	return messages
 }
 
 // fetchRestaurant returns the restaurant based on its name. It will handle the related errors and logging internally.
+// When no restaurant has exactly this name, aliases and fuzzy matching are tried; if several restaurants match,
+// a *RestaurantCandidatesError listing them is returned.
 func (a *AppHandler) fetchRestaurant(restaurantName string) (*models.Restaurant, error) {
 	restaurant, err := a.RestaurantRepo.GetRestaurantByName(restaurantName)
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, ErrRestaurantNotFound
-		}
+	if err == nil {
+		return restaurant, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 		a.Logger.WithError(err).Errorf("無法取得 %s 餐廳資訊", restaurantName)
 		return nil, ErrSystemError
 	}
-	return restaurant, nil
+
+	restaurants, err := a.RestaurantRepo.GetAllRestaurants()
+	if err != nil {
+		a.Logger.WithError(err).Error("無法取得餐廳列表")
+		return nil, ErrSystemError
+	}
+
+	matches := matchRestaurants(restaurantName, restaurants)
+	switch len(matches) {
+	case 0:
+		return nil, ErrRestaurantNotFound
+	case 1:
+		// Fetch again by its stored name to load the full profile
+		restaurant, err := a.RestaurantRepo.GetRestaurantByName(matches[0].Name)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法取得 %s 餐廳資訊", matches[0].Name)
+			return nil, ErrSystemError
+		}
+		return restaurant, nil
+	default:
+		return nil, &RestaurantCandidatesError{Query: restaurantName, Candidates: matches}
+	}
+}
+
+// checkRestaurantOpen checks the closing days and opening hours of a restaurant at t.
+func (a *AppHandler) checkRestaurantOpen(restaurant *models.Restaurant, t time.Time) error {
+	closed, err := a.RestaurantRepo.IsRestaurantClosedOn(restaurant.ID, t)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 %s 公休資訊", restaurant.Name)
+		return ErrSystemError
+	}
+	if closed {
+		return fmt.Errorf("%s %s 公休，%w", restaurant.Name, t.Format("01/02"), ErrRestaurantClosed)
+	}
+
+	if !isOpenAt(restaurant, t) {
+		hours := openingHoursOn(restaurant, t)
+		if len(hours) == 0 {
+			return fmt.Errorf("%s 週%s 未營業，%w", restaurant.Name, weekdayNames[t.Weekday()], ErrRestaurantClosed)
+		}
+		return fmt.Errorf("%s %s 未營業 (營業時間 %s)，%w", restaurant.Name, t.Format("15:04"), formatOpeningHours(hours), ErrRestaurantClosed)
+	}
+	return nil
 }
 
 // fetchMenuItems retrieves the menu items for a given restaurant.
@@ -65,6 +165,87 @@ func (a *AppHandler) fetchMenuItems(restaurantName string) ([]*models.MenuItem,
 	return menuItems, nil
 }
 
+// fetchMenuItem returns the menu item of a restaurant based on its code or name. When no item has exactly this
+// name, the names are compared after normalization; if that is still ambiguous, a *MenuItemSuggestionsError
+// listing likely items is returned.
+func (a *AppHandler) fetchMenuItem(itemName string, restaurant *models.Restaurant) (*models.MenuItem, error) {
+	if code, err := strconv.Atoi(itemName); err == nil {
+		menuItem, err := a.MenuItemRepo.GetMenuItemByCode(code, restaurant.Name)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrMenuItemNotFound
+			}
+			a.Logger.WithError(err).Errorf("無法取得 %s 第 %d 號餐點資訊", restaurant.Name, code)
+			return nil, ErrSystemError
+		}
+		return menuItem, nil
+	}
+
+	menuItem, err := a.MenuItemRepo.GetMenuItemByDetails(itemName, restaurant.Name)
+	if err == nil {
+		return menuItem, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.Logger.WithError(err).Errorf("無法取得 %s 餐點資訊", itemName)
+		return nil, ErrSystemError
+	}
+
+	menuItems, err := a.fetchMenuItems(restaurant.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	menuItem, suggestions := matchMenuItem(itemName, menuItems)
+	if menuItem != nil {
+		return menuItem, nil
+	}
+	if len(suggestions) == 0 {
+		return nil, ErrMenuItemNotFound
+	}
+	return nil, &MenuItemSuggestionsError{Query: itemName, Suggestions: suggestions}
+}
+
+// parseOrderItem splits an ordered item such as "雞腿飯*2" or "3*2" into the item and its quantity.
+// Items without a quantity are ordered once.
+func parseOrderItem(spec string) (string, int, error) {
+	spec = strings.ReplaceAll(spec, "＊", "*")
+	name, quantityString, found := strings.Cut(spec, "*")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", 0, fmt.Errorf("missing item in %q", spec)
+	}
+	if !found {
+		return name, 1, nil
+	}
+	quantity, err := strconv.Atoi(strings.TrimSpace(quantityString))
+	if err != nil || quantity < 1 || quantity > 99 {
+		return "", 0, fmt.Errorf("invalid quantity in %q", spec)
+	}
+	return name, quantity, nil
+}
+
+// parseItemNote splits the note off an ordered item such as "排骨飯*2#不要辣".
+func parseItemNote(spec string) (string, string) {
+	spec = strings.ReplaceAll(spec, "＃", "#")
+	item, note, _ := strings.Cut(spec, "#")
+	return strings.TrimSpace(item), strings.TrimSpace(note)
+}
+
+// parseItemPrice splits a hand-typed item such as "滷肉飯$40" into its name and unit price.
+// found is false when the item carries no price.
+func parseItemPrice(spec string) (name string, price int, found bool, err error) {
+	spec = strings.ReplaceAll(spec, "＄", "$")
+	name, priceString, found := strings.Cut(spec, "$")
+	if !found {
+		return spec, 0, false, nil
+	}
+	name = strings.TrimSpace(name)
+	price, err = strconv.Atoi(strings.TrimSpace(priceString))
+	if name == "" || err != nil || price < 0 {
+		return "", 0, true, fmt.Errorf("invalid price in %q", spec)
+	}
+	return name, price, true, nil
+}
+
 // checkActiveOrder checks if there's an active order for the given ID.
 func (a *AppHandler) checkActiveOrder(ID string) error {
 	order, err := a.getActiveOrderOfIDWithErrorHandling(ID)
@@ -86,8 +267,9 @@ func (a *AppHandler) createOrder(order *models.Order) error {
 	return nil
 }
 
-// generateMenuFlexContainer creates and returns the menu flex container.
-func (a *AppHandler) generateMenuFlexContainer(restaurant *models.Restaurant, menuItems []*models.MenuItem) (linebot.FlexContainer, error) {
+// generateMenuFlexContainer creates and returns the menu flex container. Items popular in the chat and items the
+// user has ordered before are marked.
+func (a *AppHandler) generateMenuFlexContainer(restaurant *models.Restaurant, menuItems []*models.MenuItem, ID string, chatID string) (linebot.FlexContainer, error) {
 	menuItemListFlexContainer, err := a.Templates.generateFlexContainer("menuItemListFlexContainer", restaurant.Name, restaurant.Tel)
 	if err != nil {
 		a.Logger.WithError(err).WithField("File", "menuItemListFlexContainer").Error("無法解析 JSON")
@@ -99,8 +281,50 @@ func (a *AppHandler) generateMenuFlexContainer(restaurant *models.Restaurant, me
 		return nil, ErrSystemError
 	}
 
+	// Insert restaurant profile above the header separator
+	header := bubbleContainer.Body.Contents[:len(bubbleContainer.Body.Contents)-1]
+	separator := bubbleContainer.Body.Contents[len(bubbleContainer.Body.Contents)-1]
+	infoRows := restaurantInfoRows(restaurant)
+	if rating := formatRating(a.fetchRestaurantRatings(restaurant.ID)[restaurant.ID]); rating != "" {
+		infoRows = append(infoRows, [2]string{"評分", rating})
+	}
+	popular, ordered := a.fetchMenuHighlights(restaurant.ID, ID, chatID)
+	if len(popular) > 0 || len(ordered) > 0 {
+		infoRows = append(infoRows, [2]string{"標示", "🔥 熱門　🔁 點過"})
+	}
+	for _, row := range infoRows {
+		infoBox, err := a.Templates.generateBoxComponent("restaurantInfoBoxComponent", row[0], row[1])
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", "restaurantInfoBoxComponent").Error("無法解析 JSON")
+			return nil, ErrSystemError
+		}
+		header = append(header, &infoBox)
+	}
+	bubbleContainer.Body.Contents = append(header, separator)
+
+	if restaurant.ImageURL != "" {
+		hero, err := a.Templates.generateBoxComponent("menuHeroBoxComponent", restaurant.ImageURL)
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", "menuHeroBoxComponent").Error("無法解析 JSON")
+			return nil, ErrSystemError
+		}
+		bubbleContainer.Hero = &hero
+	}
+
+	// Mark popular, previously ordered and low-rated items
+	itemRatings := a.fetchMenuItemRatings(restaurant.ID)
 	for _, menuItem := range menuItems {
-		newMenuItemBox, err := a.Templates.generateBoxComponent("menuItemListBoxComponent", menuItem.Name, menuItem.Price, menuItem.Name, menuItem.Name)
+		displayName := menuItem.Name
+		if isLowRated(itemRatings[menuItem.ID]) {
+			displayName = "⚠️ " + displayName
+		}
+		if ordered[menuItem.ID] {
+			displayName = "🔁 " + displayName
+		}
+		if popular[menuItem.ID] {
+			displayName = "🔥 " + displayName
+		}
+		newMenuItemBox, err := a.menuItemBoxComponent(menuItem, displayName)
 		if err != nil {
 			a.Logger.WithError(err).WithField("File", "menuItemListBoxComponent").Error("無法解析 JSON")
 			return nil, ErrSystemError
@@ -111,6 +335,33 @@ func (a *AppHandler) generateMenuFlexContainer(restaurant *models.Restaurant, me
 	return menuItemListFlexContainer, nil
 }
 
+// fetchMenuHighlights returns the most-ordered menu items of a restaurant in the chat and the items the user has
+// ordered there before. Highlights are only decorations, so errors are logged and nothing is highlighted.
+func (a *AppHandler) fetchMenuHighlights(restaurantID uint, ID string, chatID string) (map[uint]bool, map[uint]bool) {
+	popular := make(map[uint]bool)
+	if a.Config.PopularItemsCount > 0 && chatID != "" {
+		menuItemIDs, err := a.OrderDetailRepo.GetPopularMenuItemIDs(restaurantID, chatID, a.Config.PopularItemsCount)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法取得 ID %d 餐廳的熱門餐點", restaurantID)
+		}
+		for _, menuItemID := range menuItemIDs {
+			popular[menuItemID] = true
+		}
+	}
+
+	ordered := make(map[uint]bool)
+	if ID != "" {
+		menuItemIDs, err := a.OrderDetailRepo.GetMenuItemIDsOrderedByOwner(restaurantID, ID)
+		if err != nil {
+			a.Logger.WithError(err).WithField("User", a.getDisplayNameFromID(ID)).Errorf("無法取得 ID %d 餐廳的點餐紀錄", restaurantID)
+		}
+		for _, menuItemID := range menuItemIDs {
+			ordered[menuItemID] = true
+		}
+	}
+	return popular, ordered
+}
+
 func (a *AppHandler) handleNewOrderItem(args []string, ID string) (string, error) {
 	var replyString string
 
@@ -145,65 +396,404 @@ func (a *AppHandler) handleNewOrderItem(args []string, ID string) (string, error
 
 	// Create order details
 	var tailReplyString string
-	for _, itemName := range args {
-		if itemName == "" {
+	for i, itemSpec := range args {
+		if itemSpec == "" {
 			continue
-		} else if menuItem, err := a.MenuItemRepo.GetMenuItemByDetails(itemName, order.Restaurant.Name); err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return "", ErrMenuItemNotFound
+		}
+		itemSpec, note := parseItemNote(itemSpec)
+		itemName, quantity, err := parseOrderItem(itemSpec)
+		if err != nil {
+			return "", ErrInputError
+		}
+
+		newOrderDetail := &models.OrderDetail{
+			Owner:    ID,
+			Order:    order,
+			Quantity: quantity,
+			Note:     note,
+		}
+		// Items with a price are taken as typed, for restaurants with only a menu photo
+		if name, price, found, err := parseItemPrice(itemName); err != nil {
+			return "", ErrInputError
+		} else if found {
+			if err := a.checkManualPrice(name, order.Restaurant); err != nil {
+				return "", err
 			}
-			a.Logger.WithField("User", a.getDisplayNameFromID(ID)).Errorf("無法取得 %s 餐點資訊", itemName)
-			return "", ErrSystemError
+			newOrderDetail.ItemName = name
+			newOrderDetail.UnitPrice = price
 		} else {
-			newOrderDetail := &models.OrderDetail{}
-			newOrderDetail.Owner, newOrderDetail.Order, newOrderDetail.MenuItem = ID, order, menuItem
-			a.OrderDetailRepo.CreateOrderDetail(newOrderDetail)
-			replyString += fmt.Sprintf("%s 點餐成功\n", itemName)
+			itemName, choices := splitChoices(itemName)
+			menuItem, err := a.fetchMenuItem(itemName, order.Restaurant)
+			if errors.Is(err, ErrMenuItemNotFound) {
+				return "", ErrItemPriceRequired
+			} else if err != nil {
+				return "", err
+			}
+			if menuItem.IsCombo() {
+				chosen, err := resolveChoices(menuItem, choices, quantity)
+				var choicesErr *ComboChoicesError
+				if errors.As(err, &choicesErr) {
+					choicesErr.Note = note
+					choicesErr.Rest = args[i+1:]
+				}
+				if err != nil {
+					return "", err
+				}
+				newOrderDetail.Choices = strings.Join(chosen, "、")
+			} else if len(choices) > 0 {
+				return "", ErrInputError
+			}
+			newOrderDetail.MenuItem = menuItem
+			newOrderDetail.ItemName = menuItem.Name
+			newOrderDetail.UnitPrice = menuItem.Price
+		}
+
+		if err := a.OrderDetailRepo.CreateOrderDetail(newOrderDetail); err != nil {
+			a.Logger.WithError(err).WithField("User", username).Errorf("無法新增 %s 訂單細項", newOrderDetail.ItemName)
+			return "", ErrSystemError
+		}
+		a.orderEvents.publish(order.ID)
+		itemString := newOrderDetail.DisplayName()
+		if quantity > 1 {
+			itemString += fmt.Sprintf(" x%d", quantity)
 		}
+		if note != "" {
+			itemString += fmt.Sprintf(" (備註: %s)", note)
+		}
+		replyString += itemString + " 點餐成功\n"
 	}
 	replyString += tailReplyString
 	return replyString, nil
 }
 
+// checkManualPrice allows an item typed in with its price when the restaurant has menu photos, whose prices may
+// differ from the menu items, or when no menu item has its name. Otherwise the report would show the item twice at
+// different prices.
+func (a *AppHandler) checkManualPrice(itemName string, restaurant *models.Restaurant) error {
+	if len(restaurant.MenuPhotos) > 0 {
+		return nil
+	}
+	_, err := a.MenuItemRepo.GetMenuItemByDetails(itemName, restaurant.Name)
+	if err == nil {
+		return ErrItemOnMenu
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		a.Logger.WithError(err).Errorf("無法取得 %s 餐點資訊", itemName)
+		return ErrSystemError
+	}
+	return nil
+}
+
 func (a *AppHandler) handleNewRestaurant(args []string) (string, error) {
 	// Error handling: check if there are any arguments
 	if len(args) == 0 {
 		return "", ErrInputError
 	}
 
-	var restaurants []*models.Restaurant
-	// Loop through each argument and create a new restaurant
+	// Concatenate the reply string using a strings.Builder
+	var sb strings.Builder
+	// Loop through each argument and create or update the restaurant
 	for _, item := range args {
 		// Split the argument into name and telephone number
 		itemArgs := strings.Split(item, ",")
 		// Check if the argument is valid
-		if len(itemArgs) < 2 {
+		if len(itemArgs) < 2 || itemArgs[0] == "" {
 			return "", ErrInputError
 		}
 		name, tel := itemArgs[0], itemArgs[1]
-		newRestaurant := &models.Restaurant{Name: name, Tel: tel}
-		// Create the new restaurant in the database
-		err := a.RestaurantRepo.CreateRestaurant(newRestaurant)
+		restaurant := &models.Restaurant{Name: name, Tel: tel}
+		if len(itemArgs) > 2 {
+			restaurant.Address = strings.Join(itemArgs[2:], ",")
+		}
+		// Create the restaurant in the database, or update the one with the same name
+		previous, err := a.RestaurantRepo.UpsertRestaurant(restaurant)
 		if err != nil {
+			a.Logger.WithError(err).Errorf("無法新增 %s 餐廳", name)
 			return "", ErrNewRestaurantError
 		}
-		// Add the new restaurant to the list of created restaurants
-		restaurants = append(restaurants, newRestaurant)
+		sb.WriteString(describeRestaurantUpsert(previous, restaurant))
 	}
 
-	// Check if any restaurants were actually created
-	if len(restaurants) == 0 {
-		return "", ErrNewRestaurantError
+	return sb.String(), nil
+}
+
+// describeRestaurantUpsert describes the result of upserting a restaurant, e.g. "餐廳 池上 已更新 電話 02-1234→02-5678".
+func describeRestaurantUpsert(previous, restaurant *models.Restaurant) string {
+	if previous == nil {
+		return fmt.Sprintf("餐廳 %s 建立成功\n", restaurant.Name)
+	}
+
+	var changes []string
+	if previous.Tel != restaurant.Tel {
+		changes = append(changes, fmt.Sprintf("電話 %s→%s", previous.Tel, restaurant.Tel))
+	}
+	if previous.Address != restaurant.Address {
+		changes = append(changes, fmt.Sprintf("地址 %s→%s", previous.Address, restaurant.Address))
+	}
+	if len(changes) == 0 {
+		return fmt.Sprintf("餐廳 %s 已存在，未變更\n", restaurant.Name)
+	}
+	return fmt.Sprintf("餐廳 %s 已更新 %s\n", restaurant.Name, strings.Join(changes, "，"))
+}
+
+// handleEditRestaurant updates the profile of a restaurant. Each argument after
+// the restaurant name is a "field,value" pair; an empty value clears the field.
+func (a *AppHandler) handleEditRestaurant(args []string) (string, error) {
+	if len(args) < 2 || args[0] == "" {
+		return "", ErrInputError
+	}
+
+	restaurantName, fields := args[0], args[1:]
+	restaurant, err := a.fetchRestaurant(restaurantName)
+	if err != nil {
+		return "", err
 	}
 
-	// Concatenate the reply string using a strings.Builder
 	var sb strings.Builder
-	for _, r := range restaurants {
-		sb.WriteString(fmt.Sprintf("餐廳 %s 建立成功\n", r.Name))
+	sb.WriteString(fmt.Sprintf("更新餐廳 %s\n", restaurant.Name))
+	var openingHours []*models.OpeningHour
+	openingHoursChanged := false
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, ",")
+		if !ok {
+			return "", ErrInputError
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "電話":
+			restaurant.Tel = value
+		case "地址":
+			restaurant.Address = value
+		case "營業":
+			if openingHours, err = parseOpeningHours(value); err != nil {
+				return "", ErrOpeningHoursError
+			}
+			openingHoursChanged = true
+			value = formatOpeningHours(openingHours)
+		case "低消":
+			if restaurant.MinimumOrder, err = parseAmount(value); err != nil {
+				return "", ErrInputError
+			}
+		case "外送費":
+			if restaurant.DeliveryFee, err = parseAmount(value); err != nil {
+				return "", ErrInputError
+			}
+		case "方式":
+			if restaurant.ServiceMode, err = parseServiceMode(value); err != nil {
+				return "", ErrInputError
+			}
+		case "備註":
+			restaurant.Notes = value
+		default:
+			return "", ErrInputError
+		}
+
+		if value == "" {
+			value = "(清除)"
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", key, value))
+	}
+
+	if err := a.RestaurantRepo.UpdateRestaurant(restaurant); err != nil {
+		a.Logger.WithError(err).Errorf("無法更新 %s 餐廳資訊", restaurant.Name)
+		return "", ErrEditRestaurantError
+	}
+	if openingHoursChanged {
+		if err := a.RestaurantRepo.SetOpeningHours(restaurant.ID, openingHours); err != nil {
+			a.Logger.WithError(err).Errorf("無法更新 %s 營業時間", restaurant.Name)
+			return "", ErrEditRestaurantError
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// handleNewAlias adds alternative names to a restaurant.
+func (a *AppHandler) handleNewAlias(args []string) (string, error) {
+	if len(args) < 2 || args[0] == "" {
+		return "", ErrInputError
+	}
+
+	restaurantName, aliases := args[0], args[1:]
+	restaurant, err := a.fetchRestaurant(restaurantName)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("增加別名至 %s\n", restaurant.Name))
+	for _, alias := range aliases {
+		if alias == "" {
+			continue
+		}
+		if err := a.RestaurantRepo.AddRestaurantAlias(&models.RestaurantAlias{RestaurantID: restaurant.ID, Name: alias}); err != nil {
+			a.Logger.WithError(err).Errorf("無法新增 %s 的別名 %s", restaurant.Name, alias)
+			return "", ErrNewAliasError
+		}
+		sb.WriteString(fmt.Sprintf("別名 %s\n", alias))
 	}
 	return sb.String(), nil
 }
 
+// handleExportMenu replies with signed links to download the menu of a restaurant.
+func (a *AppHandler) handleExportMenu(args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", ErrInputError
+	}
+	if a.Config.APIToken == "" {
+		return "", ErrAPIDisabled
+	}
+
+	restaurant, err := a.fetchRestaurant(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(downloadLinkTTL)
+	basePath := fmt.Sprintf("/api/restaurants/%d/menu", restaurant.ID)
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s 菜單下載 (%d 小時內有效)\n", restaurant.Name, int(downloadLinkTTL.Hours())))
+	sb.WriteString(fmt.Sprintf("CSV: %s\n", a.signedURL(basePath+".csv", expires, nil)))
+	sb.WriteString(fmt.Sprintf("JSON: %s\n", a.signedURL(basePath+".json", expires, nil)))
+	return sb.String(), nil
+}
+
+// handleNewTags tags a restaurant, e.g. 標籤/池上便當/便當/素食.
+func (a *AppHandler) handleNewTags(args []string) (string, error) {
+	if len(args) < 2 || args[0] == "" {
+		return "", ErrInputError
+	}
+
+	restaurantName := args[0]
+	var tags []string
+	for _, tag := range args[1:] {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return "", ErrInputError
+	}
+
+	restaurant, err := a.fetchRestaurant(restaurantName)
+	if err != nil {
+		return "", err
+	}
+	if err := a.RestaurantRepo.AddRestaurantTags(restaurant.ID, tags); err != nil {
+		a.Logger.WithError(err).Errorf("無法新增 %s 的標籤", restaurant.Name)
+		return "", ErrSystemError
+	}
+	return fmt.Sprintf("%s 新增標籤: %s", restaurant.Name, strings.Join(tags, "、")), nil
+}
+
+// handlePickRestaurant picks a random restaurant that has any of the given tags and is open now, avoiding the
+// restaurants ordered from in the last PickAvoidDays days when possible. It replies with the menu of the picked
+// restaurant and a button to start an order.
+func (a *AppHandler) handlePickRestaurant(args []string, ID string, chatID string) (linebot.FlexContainer, error) {
+	var tags []string
+	for _, tag := range args {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	restaurants, err := a.RestaurantRepo.GetRestaurantsByTags(tags)
+	if err != nil {
+		a.Logger.WithError(err).Error("無法取得餐廳列表")
+		return nil, ErrSystemError
+	}
+
+	now := time.Now()
+	recent := make(map[uint]bool)
+	if a.Config.PickAvoidDays > 0 {
+		restaurantIDs, err := a.OrderRepo.GetRestaurantIDsOrderedSince(now.AddDate(0, 0, -a.Config.PickAvoidDays))
+		if err != nil {
+			a.Logger.WithError(err).Error("無法取得近期訂單")
+			return nil, ErrSystemError
+		}
+		for _, id := range restaurantIDs {
+			recent[id] = true
+		}
+	}
+
+	// Try restaurants not ordered from recently first, each group in random order
+	rand.Shuffle(len(restaurants), func(i, j int) {
+		restaurants[i], restaurants[j] = restaurants[j], restaurants[i]
+	})
+	sort.SliceStable(restaurants, func(i, j int) bool {
+		return !recent[restaurants[i].ID] && recent[restaurants[j].ID]
+	})
+
+	for _, restaurant := range restaurants {
+		if err := a.checkRestaurantOpen(restaurant, now); errors.Is(err, ErrRestaurantClosed) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		menuItems, err := a.fetchMenuItems(restaurant.Name)
+		if err != nil {
+			return nil, err
+		}
+		container, err := a.generateMenuFlexContainer(restaurant, menuItems, ID, chatID)
+		if err != nil {
+			return nil, err
+		}
+
+		footer, err := a.Templates.generateBoxComponent("pickFooterBoxComponent", restaurant.Name)
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", "pickFooterBoxComponent").Error("無法解析 JSON")
+			return nil, ErrSystemError
+		}
+		container.(*linebot.BubbleContainer).Footer = &footer
+		return container, nil
+	}
+
+	return nil, ErrNoRestaurantToPick
+}
+
+// handleNewClosure records one-off closing days of a restaurant.
+func (a *AppHandler) handleNewClosure(args []string) (string, error) {
+	if len(args) < 2 || args[0] == "" {
+		return "", ErrInputError
+	}
+
+	restaurantName, dates := args[0], args[1:]
+	restaurant, err := a.fetchRestaurant(restaurantName)
+	if err != nil {
+		return "", err
+	}
+
+	var days []string
+	now := time.Now()
+	for _, d := range dates {
+		date, err := parseDate(d, now)
+		if err != nil {
+			return "", ErrInputError
+		}
+		closure := &models.RestaurantClosure{RestaurantID: restaurant.ID, Date: date}
+		if err := a.RestaurantRepo.AddRestaurantClosure(closure); err != nil {
+			a.Logger.WithError(err).Errorf("無法新增 %s 公休日", restaurant.Name)
+			return "", ErrSystemError
+		}
+		days = append(days, date.Format("2006/01/02"))
+	}
+
+	return fmt.Sprintf("已記錄 %s 公休日: %s", restaurant.Name, strings.Join(days, "、")), nil
+}
+
+// parseAmount parses a non-negative amount in dollars, treating an empty string as zero.
+func parseAmount(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	amount, err := strconv.Atoi(s)
+	if err != nil || amount < 0 {
+		return 0, ErrInputError
+	}
+	return amount, nil
+}
+
 func (a *AppHandler) handleNewMenuItem(args []string) (string, error) {
 	if len(args) < 2 {
 		return "", ErrInputError
@@ -211,13 +801,9 @@ func (a *AppHandler) handleNewMenuItem(args []string) (string, error) {
 
 	// Get restaurant
 	restaurantName, items := args[0], args[1:]
-	restaurant, err := a.RestaurantRepo.GetRestaurantByName(restaurantName)
+	restaurant, err := a.fetchRestaurant(restaurantName)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return "", ErrRestaurantNotFound
-		}
-		a.Logger.WithError(err).Errorf("無法取得 %s 餐廳資訊", restaurantName)
-		return "", ErrSystemError
+		return "", err
 	}
 
 	if len(items) == 0 {
@@ -226,7 +812,7 @@ func (a *AppHandler) handleNewMenuItem(args []string) (string, error) {
 
 	// Create menuitem
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("增加餐點至 %s\n", restaurantName))
+	sb.WriteString(fmt.Sprintf("增加餐點至 %s\n", restaurant.Name))
 	for _, item := range items {
 		itemArgs := strings.Split(item, ",")
 		if len(itemArgs) < 2 {
@@ -238,17 +824,88 @@ func (a *AppHandler) handleNewMenuItem(args []string) (string, error) {
 			return "", ErrInputError
 		}
 
-		newMenuItem := &models.MenuItem{Name: name, Price: price, Restaurant: restaurant}
-		if err := a.MenuItemRepo.CreateMenuItem(newMenuItem); err != nil {
+		menuItem := &models.MenuItem{Name: name, Price: price, RestaurantID: restaurant.ID, Restaurant: restaurant}
+		previous, err := a.MenuItemRepo.UpsertMenuItem(menuItem)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法新增 %s 餐點 %s", restaurant.Name, name)
 			return "", ErrNewMenuItemError
 		}
 
-		sb.WriteString(fmt.Sprintf("餐點 %s %d 元\n", name, price))
-
+		sb.WriteString(describeMenuItemUpsert(previous, menuItem))
 	}
 	return sb.String(), nil
 }
 
+// describeMenuItemUpsert describes the result of upserting a menu item, e.g. "餐點 雞腿飯 更新價格 80→85".
+func describeMenuItemUpsert(previous, menuItem *models.MenuItem) string {
+	switch {
+	case previous == nil:
+		return fmt.Sprintf("餐點 %s %d 元\n", menuItem.Name, menuItem.Price)
+	case previous.Price != menuItem.Price:
+		return fmt.Sprintf("餐點 %s 更新價格 %d→%d\n", menuItem.Name, previous.Price, menuItem.Price)
+	}
+	return fmt.Sprintf("餐點 %s %d 元，未變更\n", menuItem.Name, menuItem.Price)
+}
+
+// maxSearchResults limits the menu items listed by 找 to keep the reply within the Flex message size limit.
+const maxSearchResults = 30
+
+// handleSearchMenuItems handles 找/品項, listing the restaurants whose menus have items containing the query.
+func (a *AppHandler) handleSearchMenuItems(args []string) (linebot.FlexContainer, error) {
+	if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+		return nil, ErrInputError
+	}
+	query := strings.TrimSpace(args[0])
+
+	menuItems, err := a.MenuItemRepo.SearchMenuItems(query, maxSearchResults)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法搜尋 %s 餐點", query)
+		return nil, ErrSystemError
+	}
+	if len(menuItems) == 0 {
+		return nil, ErrNoSearchResult
+	}
+
+	// Group the items by restaurant, keeping their order
+	var restaurants []*models.Restaurant
+	itemsByRestaurant := make(map[uint][]*models.MenuItem)
+	for _, menuItem := range menuItems {
+		if _, ok := itemsByRestaurant[menuItem.RestaurantID]; !ok {
+			restaurants = append(restaurants, menuItem.Restaurant)
+		}
+		itemsByRestaurant[menuItem.RestaurantID] = append(itemsByRestaurant[menuItem.RestaurantID], menuItem)
+	}
+
+	container, err := a.Templates.generateFlexContainer("searchResultFlexContainer", query, len(restaurants))
+	if err != nil {
+		a.Logger.WithError(err).WithField("File", "searchResultFlexContainer").Error("無法解析 JSON")
+		return nil, ErrSystemError
+	}
+	bubbleContainer, ok := container.(*linebot.BubbleContainer)
+	if !ok {
+		return nil, ErrSystemError
+	}
+
+	for _, restaurant := range restaurants {
+		restaurantBox, err := a.Templates.generateBoxComponent("searchRestaurantBoxComponent", restaurant.Name, restaurant.Name, restaurant.Name)
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", "searchRestaurantBoxComponent").Error("無法解析 JSON")
+			return nil, ErrSystemError
+		}
+		bubbleContainer.Body.Contents = append(bubbleContainer.Body.Contents, &restaurantBox)
+
+		for _, menuItem := range itemsByRestaurant[restaurant.ID] {
+			itemBox, err := a.Templates.generateBoxComponent("searchItemBoxComponent", menuItem.Name, menuItem.Price)
+			if err != nil {
+				a.Logger.WithError(err).WithField("File", "searchItemBoxComponent").Error("無法解析 JSON")
+				return nil, ErrSystemError
+			}
+			bubbleContainer.Body.Contents = append(bubbleContainer.Body.Contents, &itemBox)
+		}
+	}
+	return container, nil
+}
+
 func (a *AppHandler) handleGetAllRestaurants(args []string) (linebot.FlexContainer, error) {
 	// Error handling
 	if len(args) > 1 || args[0] != "" {
@@ -273,8 +930,10 @@ func (a *AppHandler) handleGetAllRestaurants(args []string) (linebot.FlexContain
 	}
 
 	// Add restaurant box into container
+	ratings := a.fetchRestaurantRatings()
 	for _, restaurant := range restaurants {
-		restaurantListBoxComponent, err := a.Templates.generateBoxComponent("restaurantListBoxComponent", restaurant.Name, restaurant.Tel, restaurant.Name, restaurant.Name)
+		subtitle := strings.TrimSpace(restaurant.Tel + " " + formatRating(ratings[restaurant.ID]))
+		restaurantListBoxComponent, err := a.Templates.generateBoxComponent("restaurantListBoxComponent", restaurant.Name, subtitle, restaurant.Name, restaurant.Name)
 		if err != nil {
 			a.Logger.WithError(err).Error("無法解析 restaurantListBoxComponent")
 			return nil, ErrSystemError
@@ -333,78 +992,160 @@ func (a *AppHandler) handleClearOrder(args []string, ID string) (string, error)
 		a.Logger.WithError(err).Errorf("無法刪除 ID %d 的訂單", order.ID)
 		return "", ErrSystemError
 	}
+	a.orderEvents.publish(order.ID)
 
 	return "已清除訂單", nil
 }
 
-// This function handles the statistic of an active order for a given ID.
-func (a *AppHandler) handleStatistic(args []string, ID string) (string, error) {
+// handleStatistic saves the report of the active order of the given ID and replies with its summary as a Flex
+// message, whose alternative text is the restaurant report.
+func (a *AppHandler) handleStatistic(args []string, ID string) ([]linebot.SendingMessage, error) {
 	// Check if input is valid
 	if len(args) > 1 || args[0] != "" {
-		return "", ErrInputError
+		return nil, ErrInputError
 	}
 
 	// Get active order
 	order, err := a.getActiveOrderOfIDWithErrorHandling(ID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if order == nil {
-		return "", ErrNoOrderInProgress
+		return nil, ErrNoOrderInProgress
 	}
 
 	// Get order details
 	orderDetails, err := a.OrderDetailRepo.GetActiveOrderDetailsByOrderID(order.ID)
 	if err != nil {
 		a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單細項", order.ID)
-		return "", ErrSystemError
-	}
-
-	// Calculate totals
-	totals := calculateTotals(orderDetails)
-
-	// Generate userReport
-	var userReport strings.Builder
-	fmt.Fprintf(&userReport, "%s<br>", order.Restaurant.Name)
-	for _, od := range orderDetails {
-		userName := a.getDisplayNameFromID(od.Owner)
-		fmt.Fprintf(&userReport, "%s / %s / %d<br>", userName, od.MenuItem.Name, od.MenuItem.Price)
+		return nil, ErrSystemError
 	}
 
 	// Save userReport
-	if err := a.OrderRepo.SaveOrderReport(order.ID, userReport.String()); err != nil {
+	report := a.newOrderReport(order, orderDetails, time.Now())
+	if err := a.OrderRepo.SaveOrderReport(order.ID, report); err != nil {
 		a.Logger.Printf("Could not save report to Database: %v", err)
-		return "", ErrSystemError
+		return nil, ErrSystemError
 	}
 	// Get userReport ID
 	userReportID := ""
 	if userReportID, err = a.OrderRepo.GetOrderReportIDByOrderID(order.ID); err != nil {
 		a.Logger.Printf("Could not get report from Database: %v", err)
-		return "", ErrSystemError
+		return nil, ErrSystemError
 	}
-	userReportURL := "https://" + a.Config.SiteURL + ":" + a.Config.Port + "/userReport/" + userReportID
+	userReportURL := a.publicURL("/userReport/" + userReportID)
 
-	// Generate restaurantReport
-	var restaurantReport strings.Builder
-	totalItemCount := 0
-	totalPrice := 0
+	container, err := a.generateStatisticFlexContainer(report, userReportURL)
+	if err != nil {
+		return nil, err
+	}
+	altText := truncateText(generateRestaurantReport(report), maxAltTextLength)
+	return []linebot.SendingMessage{linebot.NewFlexMessage(altText, container)}, nil
+}
+
+// maxStatisticItemRows and maxStatisticParticipants limit the rows of the 統計 summary to keep it within the Flex
+// message size limit. The full report is behind its link.
+const (
+	maxStatisticItemRows     = 30
+	maxStatisticParticipants = 20
+)
 
-	fmt.Fprintf(&restaurantReport, "%s:\n", order.Restaurant.Name)
-	for itemName, details := range totals {
-		count := len(details)
-		price := 0
-		if count > 0 {
-			price = details[0].MenuItem.Price * count
+// generateStatisticFlexContainer summarizes a report with the item totals and the subtotal of each participant,
+// with buttons to open the full report and to call the restaurant. Long reports are cut short.
+func (a *AppHandler) generateStatisticFlexContainer(report *models.OrderReport, reportURL string) (linebot.FlexContainer, error) {
+	page := newUserReportPage(report)
+	container, err := a.Templates.generateFlexContainer("statisticFlexContainer", report.Restaurant, page.Quantity, formatPrice(page.Total))
+	if err != nil {
+		a.Logger.WithError(err).WithField("File", "statisticFlexContainer").Error("無法解析 JSON")
+		return nil, ErrSystemError
+	}
+	bubbleContainer, ok := container.(*linebot.BubbleContainer)
+	if !ok {
+		return nil, ErrSystemError
+	}
+
+	addBox := func(name string, args ...interface{}) error {
+		box, err := a.Templates.generateBoxComponent(name, args...)
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", name).Error("無法解析 JSON")
+			return ErrSystemError
 		}
-		fmt.Fprintf(&restaurantReport, "%s / %d 份 / 共 %d 元\n", itemName, count, price)
+		bubbleContainer.Body.Contents = append(bubbleContainer.Body.Contents, &box)
+		return nil
+	}
 
-		totalItemCount += count
-		totalPrice += price
+	if err := addBox("statisticSectionBoxComponent", "品項"); err != nil {
+		return nil, err
+	}
+	totals := calculateTotals(report.Lines)
+	rows := 0
+	for i, total := range totals {
+		// An item is listed with its notes or not at all
+		if rows += 1 + len(total.Notes); rows > maxStatisticItemRows {
+			if err := addBox("statisticMoreBoxComponent", fmt.Sprintf("…及其他 %d 項", len(totals)-i)); err != nil {
+				return nil, err
+			}
+			break
+		}
+		name := total.Name
+		if total.Code != 0 {
+			name = fmt.Sprintf("%d. %s", total.Code, total.Name)
+		}
+		if err := addBox("statisticRowBoxComponent", name, fmt.Sprintf("%d 份 / %s 元", total.Quantity, formatPrice(total.Price))); err != nil {
+			return nil, err
+		}
+		for _, note := range total.Notes {
+			if err := addBox("statisticNoteBoxComponent", note.Note, note.Quantity); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(page.Participants) > 0 {
+		if err := addBox("statisticSectionBoxComponent", "每人小計"); err != nil {
+			return nil, err
+		}
+	}
+	for i, participant := range page.Participants {
+		if i == maxStatisticParticipants {
+			if err := addBox("statisticMoreBoxComponent", fmt.Sprintf("…及其他 %d 人", len(page.Participants)-i)); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if err := addBox("statisticRowBoxComponent", participant.Name, formatPrice(participant.Subtotal)+" 元"); err != nil {
+			return nil, err
+		}
 	}
 
-	fmt.Fprintf(&restaurantReport, "總計: 共 %d 份 / 共 %d 元\n", totalItemCount, totalPrice)
+	footer, err := a.Templates.generateBoxComponent("statisticFooterBoxComponent", reportURL)
+	if err != nil {
+		a.Logger.WithError(err).WithField("File", "statisticFooterBoxComponent").Error("無法解析 JSON")
+		return nil, ErrSystemError
+	}
+	if tel := telURINumber(report.Tel); tel != "" {
+		telButton, err := a.Templates.generateBoxComponent("statisticTelButtonBoxComponent", tel)
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", "statisticTelButtonBoxComponent").Error("無法解析 JSON")
+			return nil, ErrSystemError
+		}
+		footer.Contents = append(footer.Contents, &telButton)
+	}
+	bubbleContainer.Footer = &footer
+	return container, nil
+}
 
-	return userReportURL + "\n\n" + restaurantReport.String(), nil
+// telURINumber keeps the characters of a phone number allowed in a tel: URI, e.g. "02-1234-5678 #12" becomes
+// "02-1234-5678". Extensions and other text are dropped.
+func telURINumber(tel string) string {
+	tel, _, _ = strings.Cut(tel, "#")
+	var sb strings.Builder
+	for _, r := range tel {
+		if (r >= '0' && r <= '9') || r == '+' || r == '-' {
+			sb.WriteRune(r)
+		}
+	}
+	return strings.Trim(sb.String(), "-")
 }
 
 func (a *AppHandler) handleGetAllOrders(args []string, ID string) (string, error) {
@@ -426,11 +1167,134 @@ func (a *AppHandler) handleGetAllOrders(args []string, ID string) (string, error
 	}
 }
 
-// This function calculates the totals for each item in the order.
-func calculateTotals(orderDetails []*models.OrderDetail) map[string][]*models.OrderDetail {
-	totals := make(map[string][]*models.OrderDetail)
+// newOrderReport takes a snapshot of the order details of an order, looking up the display name of each participant
+// once.
+func (a *AppHandler) newOrderReport(order *models.Order, orderDetails []*models.OrderDetail, generatedAt time.Time) *models.OrderReport {
+	// Participants whose name cannot be looked up are shown by user ID
+	report, _ := a.buildOrderReport(order, orderDetails, generatedAt, func(userID string) (string, error) {
+		return a.getDisplayNameFromID(userID), nil
+	})
+	return report
+}
+
+// buildOrderReport is newOrderReport with the names of participants looked up by displayName, failing with the first
+// name that cannot be looked up.
+func (a *AppHandler) buildOrderReport(order *models.Order, orderDetails []*models.OrderDetail, generatedAt time.Time, displayName func(userID string) (string, error)) (*models.OrderReport, error) {
+	report := &models.OrderReport{GeneratedAt: generatedAt}
+	if order.Restaurant != nil {
+		report.Restaurant = order.Restaurant.Name
+		report.Tel = order.Restaurant.Tel
+	}
+	names := make(map[string]string)
 	for _, od := range orderDetails {
-		totals[od.MenuItem.Name] = append(totals[od.MenuItem.Name], od)
+		name, ok := names[od.Owner]
+		if !ok {
+			var err error
+			if name, err = displayName(od.Owner); err != nil {
+				return nil, fmt.Errorf("failed to get display name of %s: %w", od.Owner, err)
+			}
+			names[od.Owner] = name
+		}
+		report.Lines = append(report.Lines, newReportLine(od, name))
+	}
+	return report, nil
+}
+
+// newReportLine takes a snapshot of an order detail ordered by participant.
+func newReportLine(od *models.OrderDetail, participant string) *models.ReportLine {
+	line := &models.ReportLine{
+		Participant: participant,
+		Item:        od.DisplayName(),
+		Note:        od.Note,
+		Quantity:    od.Quantity,
+		UnitPrice:   od.UnitPrice,
+		Subtotal:    od.Subtotal(),
+	}
+	if od.MenuItem != nil {
+		line.Code = od.MenuItem.Code
+	}
+	return line
+}
+
+// itemTotal is the quantity and price of an item over all order details of an order, with the notes left on it.
+type itemTotal struct {
+	Name     string
+	Code     int // 0 for items typed in by hand or removed from the menu
+	Quantity int
+	Price    int
+	Notes    []*noteTotal
+}
+
+// noteTotal is the quantity of an item ordered with the same note.
+type noteTotal struct {
+	Note     string
+	Quantity int
+}
+
+// calculateTotals sums the lines of a report by item. Items are sorted by their menu code, followed by items typed
+// in by hand sorted by name, and notes keep the order they were left in.
+func calculateTotals(lines []*models.ReportLine) []*itemTotal {
+	var totals []*itemTotal
+	byName := make(map[string]*itemTotal)
+	for _, line := range lines {
+		total, ok := byName[line.Item]
+		if !ok {
+			total = &itemTotal{Name: line.Item}
+			byName[line.Item] = total
+			totals = append(totals, total)
+		}
+		if line.Code != 0 && (total.Code == 0 || line.Code < total.Code) {
+			total.Code = line.Code
+		}
+		total.Quantity += line.Quantity
+		total.Price += line.Subtotal
+		if line.Note != "" {
+			total.addNote(line.Note, line.Quantity)
+		}
 	}
+
+	sort.SliceStable(totals, func(i, j int) bool {
+		if (totals[i].Code == 0) != (totals[j].Code == 0) {
+			return totals[j].Code == 0
+		}
+		if totals[i].Code != totals[j].Code {
+			return totals[i].Code < totals[j].Code
+		}
+		return totals[i].Name < totals[j].Name
+	})
 	return totals
 }
+
+func (t *itemTotal) addNote(note string, quantity int) {
+	for _, n := range t.Notes {
+		if n.Note == note {
+			n.Quantity += quantity
+			return
+		}
+	}
+	t.Notes = append(t.Notes, &noteTotal{Note: note, Quantity: quantity})
+}
+
+// generateRestaurantReport formats the totals of a report to read out to the restaurant.
+func generateRestaurantReport(report *models.OrderReport) string {
+	var sb strings.Builder
+	totalItemCount := 0
+	totalPrice := 0
+
+	fmt.Fprintf(&sb, "%s:\n", report.Restaurant)
+	for _, total := range calculateTotals(report.Lines) {
+		if total.Code != 0 {
+			fmt.Fprintf(&sb, "%d. ", total.Code)
+		}
+		fmt.Fprintf(&sb, "%s / %d 份 / 共 %d 元\n", total.Name, total.Quantity, total.Price)
+		for _, note := range total.Notes {
+			fmt.Fprintf(&sb, "  備註: %s x%d\n", note.Note, note.Quantity)
+		}
+
+		totalItemCount += total.Quantity
+		totalPrice += total.Price
+	}
+
+	fmt.Fprintf(&sb, "總計: 共 %d 份 / 共 %d 元\n", totalItemCount, totalPrice)
+	return sb.String()
+}
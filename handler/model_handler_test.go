@@ -1,9 +1,16 @@
 package handler
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/JohnsonYuanTW/NCAEats/config"
 	"github.com/JohnsonYuanTW/NCAEats/models"
 	"github.com/line/line-bot-sdk-go/v7/linebot"
 	"github.com/sirupsen/logrus"
@@ -26,11 +33,69 @@ func (m *MockRestaurantRepository) CreateRestaurant(restaurant *models.Restauran
 	return args.Error(0)
 }
 
+func (m *MockRestaurantRepository) UpsertRestaurant(restaurant *models.Restaurant) (*models.Restaurant, error) {
+	args := m.Called(restaurant)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.Restaurant), args.Error(1)
+}
+
+func (m *MockRestaurantRepository) UpdateRestaurant(restaurant *models.Restaurant) error {
+	args := m.Called(restaurant)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) AddMenuPhoto(photo *models.MenuPhoto) error {
+	args := m.Called(photo)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) DeleteMenuPhotos(restaurantID uint) error {
+	args := m.Called(restaurantID)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) SetRestaurantImageURL(restaurantID uint, imageURL string) error {
+	args := m.Called(restaurantID, imageURL)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) SetOpeningHours(restaurantID uint, hours []*models.OpeningHour) error {
+	args := m.Called(restaurantID, hours)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) AddRestaurantAlias(alias *models.RestaurantAlias) error {
+	args := m.Called(alias)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) AddRestaurantTags(restaurantID uint, tags []string) error {
+	args := m.Called(restaurantID, tags)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) AddRestaurantClosure(closure *models.RestaurantClosure) error {
+	args := m.Called(closure)
+	return args.Error(0)
+}
+
+func (m *MockRestaurantRepository) IsRestaurantClosedOn(restaurantID uint, t time.Time) (bool, error) {
+	args := m.Called(restaurantID, t)
+	return args.Bool(0), args.Error(1)
+}
+
 func (m *MockRestaurantRepository) GetAllRestaurants() ([]*models.Restaurant, error) {
 	args := m.Called()
 	return args.Get(0).([]*models.Restaurant), args.Error(1)
 }
 
+func (m *MockRestaurantRepository) GetRestaurantsByTags(tags []string) ([]*models.Restaurant, error) {
+	args := m.Called(tags)
+	return args.Get(0).([]*models.Restaurant), args.Error(1)
+}
+
 func (m *MockRestaurantRepository) GetRestaurantByName(name string) (*models.Restaurant, error) {
 	args := m.Called(name)
 	if args.Get(0) == nil {
@@ -39,6 +104,14 @@ func (m *MockRestaurantRepository) GetRestaurantByName(name string) (*models.Res
 	return args.Get(0).(*models.Restaurant), args.Error(1)
 }
 
+func (m *MockRestaurantRepository) GetRestaurantByID(id uint) (*models.Restaurant, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.Restaurant), args.Error(1)
+}
+
 func (m *MockRestaurantRepository) DeleteRestaurant(id uint) error {
 	args := m.Called(id)
 	return args.Error(0)
@@ -68,24 +141,45 @@ func (m *MockOrderRepository) GetActiveOrdersOfOwnerID(ownerID string) ([]*model
 	return args.Get(0).([]*models.Order), args.Error(1)
 }
 
+func (m *MockOrderRepository) GetOrderByID(orderID uint) (*models.Order, error) {
+	args := m.Called(orderID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.Order), args.Error(1)
+}
+
 func (m *MockOrderRepository) CountActiveOrdersOfOwnerID(ownerID string) (int64, error) {
 	args := m.Called(ownerID)
 	return args.Get(0).(int64), args.Error(1)
 }
 
-func (m *MockOrderRepository) SaveOrderReport(orderID uint, report string) error {
+func (m *MockOrderRepository) GetRestaurantIDsOrderedSince(t time.Time) ([]uint, error) {
+	args := m.Called(t)
+	return args.Get(0).([]uint), args.Error(1)
+}
+
+func (m *MockOrderRepository) GetClosedOrdersOfChatID(chatID string, from, to time.Time) ([]*models.Order, error) {
+	args := m.Called(chatID, from, to)
+	return args.Get(0).([]*models.Order), args.Error(1)
+}
+
+func (m *MockOrderRepository) SaveOrderReport(orderID uint, report *models.OrderReport) error {
 	args := m.Called(orderID, report)
 	return args.Error(0)
 }
 
-func (m *MockOrderRepository) GenerateUniqueReportID() string {
-	args := m.Called()
-	return args.String(0)
+func (m *MockOrderRepository) RevokeReportID(orderID uint) error {
+	args := m.Called(orderID)
+	return args.Error(0)
 }
 
-func (m *MockOrderRepository) GetOrderReportByOrderID(orderID uint) (string, error) {
+func (m *MockOrderRepository) GetOrderReportByOrderID(orderID uint) (*models.OrderReport, error) {
 	args := m.Called(orderID)
-	return args.String(0), args.Error(1)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.OrderReport), args.Error(1)
 }
 
 func (m *MockOrderRepository) GetOrderReportIDByOrderID(orderID uint) (string, error) {
@@ -98,6 +192,21 @@ func (m *MockOrderRepository) GetOrderIDByReportID(reportID string) (uint, error
 	return args.Get(0).(uint), args.Error(1)
 }
 
+func (m *MockOrderRepository) GetOrderIDsWithLegacyReport() ([]uint, error) {
+	args := m.Called()
+	return args.Get(0).([]uint), args.Error(1)
+}
+
+func (m *MockOrderRepository) SaveLegacyReport(orderID uint, report *models.OrderReport) error {
+	args := m.Called(orderID, report)
+	return args.Error(0)
+}
+
+func (m *MockOrderRepository) DropLegacyReports() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
 func (m *MockOrderRepository) DeleteOrderByOrderID(orderID uint) error {
 	args := m.Called(orderID)
 	return args.Error(0)
@@ -122,6 +231,21 @@ func (m *MockOrderDetailRepository) GetActiveOrderDetailsByOrderID(orderID uint)
 	return args.Get(0).([]*models.OrderDetail), args.Error(1)
 }
 
+func (m *MockOrderDetailRepository) GetAllOrderDetailsByOrderID(orderID uint) ([]*models.OrderDetail, error) {
+	args := m.Called(orderID)
+	return args.Get(0).([]*models.OrderDetail), args.Error(1)
+}
+
+func (m *MockOrderDetailRepository) GetPopularMenuItemIDs(restaurantID uint, chatID string, limit int) ([]uint, error) {
+	args := m.Called(restaurantID, chatID, limit)
+	return args.Get(0).([]uint), args.Error(1)
+}
+
+func (m *MockOrderDetailRepository) GetMenuItemIDsOrderedByOwner(restaurantID uint, owner string) ([]uint, error) {
+	args := m.Called(restaurantID, owner)
+	return args.Get(0).([]uint), args.Error(1)
+}
+
 func (m *MockOrderDetailRepository) DeleteOrderDetailsByOrderID(orderID uint) error {
 	args := m.Called(orderID)
 	return args.Error(0)
@@ -141,6 +265,14 @@ func (m *MockMenuItemRepository) CreateMenuItem(item *models.MenuItem) error {
 	return args.Error(0)
 }
 
+func (m *MockMenuItemRepository) UpsertMenuItem(item *models.MenuItem) (*models.MenuItem, error) {
+	args := m.Called(item)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.MenuItem), args.Error(1)
+}
+
 func (m *MockMenuItemRepository) GetMenuItemsByRestaurantName(name string) ([]*models.MenuItem, error) {
 	args := m.Called(name)
 	return args.Get(0).([]*models.MenuItem), args.Error(1)
@@ -151,6 +283,50 @@ func (m *MockMenuItemRepository) GetMenuItemByDetails(detail1, detail2 string) (
 	return args.Get(0).(*models.MenuItem), args.Error(1)
 }
 
+func (m *MockMenuItemRepository) GetMenuItemByCode(code int, restaurantName string) (*models.MenuItem, error) {
+	args := m.Called(code, restaurantName)
+	return args.Get(0).(*models.MenuItem), args.Error(1)
+}
+
+func (m *MockMenuItemRepository) SearchMenuItems(query string, limit int) ([]*models.MenuItem, error) {
+	args := m.Called(query, limit)
+	return args.Get(0).([]*models.MenuItem), args.Error(1)
+}
+
+func (m *MockMenuItemRepository) SetComboSlots(menuItemID uint, slots []*models.ComboSlot) error {
+	args := m.Called(menuItemID, slots)
+	return args.Error(0)
+}
+
+func (m *MockMenuItemRepository) SetMenuItemImageURL(menuItemID uint, imageURL string) error {
+	args := m.Called(menuItemID, imageURL)
+	return args.Error(0)
+}
+
+type MockRatingRepository struct {
+	mock.Mock
+}
+
+func (m *MockRatingRepository) Init() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockRatingRepository) SaveRating(rating *models.Rating) error {
+	args := m.Called(rating)
+	return args.Error(0)
+}
+
+func (m *MockRatingRepository) GetRestaurantRatingSummaries(restaurantIDs ...uint) (map[uint]models.RatingSummary, error) {
+	args := m.Called(restaurantIDs)
+	return args.Get(0).(map[uint]models.RatingSummary), args.Error(1)
+}
+
+func (m *MockRatingRepository) GetMenuItemRatingSummaries(restaurantID uint) (map[uint]models.RatingSummary, error) {
+	args := m.Called(restaurantID)
+	return args.Get(0).(map[uint]models.RatingSummary), args.Error(1)
+}
+
 type MockTemplateHandler struct {
 	mock.Mock
 }
@@ -175,6 +351,20 @@ func (m *MockTemplateHandler) generateBoxComponent(templateName string, args ...
 	return mockArgs.Get(0).(linebot.BoxComponent), mockArgs.Error(1)
 }
 
+func (m *MockTemplateHandler) renderHTML(w io.Writer, name string, data interface{}) error {
+	args := m.Called(w, name, data)
+	return args.Error(0)
+}
+
+// loadTemplates loads the templates of the repository.
+func loadTemplates(t *testing.T) *TemplateHandler {
+	templates, err := NewTemplateHandler(filepath.Join("..", "templates"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return templates
+}
+
 func TestHandleNewOrder(t *testing.T) {
 	var (
 		appHandler          AppHandler
@@ -190,16 +380,31 @@ func TestHandleNewOrder(t *testing.T) {
 	appHandler.Templates = &mockTemplateHandler
 
 	t.Run("should return error on invalid input", func(t *testing.T) {
-		_, err := appHandler.handleNewOrder([]string{}, "123")
+		_, err := appHandler.handleNewOrder([]string{}, "123", "123")
 		assert.Equal(t, ErrInputError, err)
 	})
 
 	t.Run("should handle not found restaurant", func(t *testing.T) {
 		mockRestaurantRepo.On("GetRestaurantByName", "unknownRestaurant").Return(nil, gorm.ErrRecordNotFound)
-		_, err := appHandler.handleNewOrder([]string{"unknownRestaurant"}, "123")
+		mockRestaurantRepo.On("GetAllRestaurants").Return([]*models.Restaurant{}, nil)
+		_, err := appHandler.handleNewOrder([]string{"unknownRestaurant"}, "123", "123")
 		assert.Equal(t, ErrRestaurantNotFound, err)
 	})
 
+	t.Run("should refuse a restaurant on its closing day", func(t *testing.T) {
+		closedRestaurant := &models.Restaurant{Model: gorm.Model{ID: 1}, Name: "closedRestaurant"}
+		mockRestaurantRepo.On("GetRestaurantByName", "closedRestaurant").Return(closedRestaurant, nil)
+		mockRestaurantRepo.On("IsRestaurantClosedOn", uint(1), mock.Anything).Return(true, nil)
+		_, err := appHandler.handleNewOrder([]string{"closedRestaurant"}, "123", "123")
+		assert.ErrorIs(t, err, ErrRestaurantClosed)
+	})
+
+	t.Run("should refuse a deadline in the past", func(t *testing.T) {
+		mockRestaurantRepo.On("GetRestaurantByName", "validRestaurant").Return(&models.Restaurant{Name: "validRestaurant"}, nil)
+		_, err := appHandler.handleNewOrder([]string{"validRestaurant", "00:00"}, "123", "123")
+		assert.Equal(t, ErrDeadlineError, err)
+	})
+
 	// ... Other tests for handleNewOrder ...
 
 	mockRestaurantRepo.AssertExpectations(t)
@@ -219,6 +424,12 @@ func TestFetchRestaurant(t *testing.T) {
 	appHandler.RestaurantRepo = &mockRestaurantRepo
 	appHandler.Logger = logger
 
+	mockRestaurantRepo.On("GetAllRestaurants").Return([]*models.Restaurant{
+		{Name: "池上便當"},
+		{Name: "池上飯包"},
+		{Name: "八方雲集", Aliases: []*models.RestaurantAlias{{Name: "八方"}}},
+	}, nil)
+
 	t.Run("should handle not found restaurant", func(t *testing.T) {
 		// Define the behavior for our mock when "GetRestaurantByName" is called.
 		mockRestaurantRepo.On("GetRestaurantByName", "unknownRestaurant").Return(nil, gorm.ErrRecordNotFound)
@@ -254,6 +465,30 @@ func TestFetchRestaurant(t *testing.T) {
 
 		mockRestaurantRepo.AssertExpectations(t)
 	})
+
+	t.Run("should fetch restaurant by alias", func(t *testing.T) {
+		expectedRestaurant := &models.Restaurant{Name: "八方雲集"}
+		mockRestaurantRepo.On("GetRestaurantByName", "八方").Return(nil, gorm.ErrRecordNotFound)
+		mockRestaurantRepo.On("GetRestaurantByName", "八方雲集").Return(expectedRestaurant, nil)
+
+		restaurant, err := appHandler.fetchRestaurant("八方")
+		assert.NoError(t, err)
+		assert.Equal(t, expectedRestaurant, restaurant)
+
+		mockRestaurantRepo.AssertExpectations(t)
+	})
+
+	t.Run("should return candidates for ambiguous names", func(t *testing.T) {
+		mockRestaurantRepo.On("GetRestaurantByName", "池上").Return(nil, gorm.ErrRecordNotFound)
+
+		_, err := appHandler.fetchRestaurant("池上")
+		var candidatesErr *RestaurantCandidatesError
+		if assert.ErrorAs(t, err, &candidatesErr) {
+			assert.Len(t, candidatesErr.Candidates, 2)
+		}
+
+		mockRestaurantRepo.AssertExpectations(t)
+	})
 }
 
 func TestFetchMenuItems(t *testing.T) {
@@ -303,6 +538,319 @@ func TestFetchMenuItems(t *testing.T) {
 	}
 }
 
+func TestCalculateTotals(t *testing.T) {
+	// The menu item was renamed and repriced after these details were ordered.
+	menuItem := &models.MenuItem{Name: "RenamedItem", Price: 100, Code: 2}
+	combo := &models.MenuItem{Name: "Combo", Price: 120, Code: 1}
+	orderDetails := []*models.OrderDetail{
+		{Owner: "A", MenuItem: menuItem, ItemName: "Item1", UnitPrice: 80, Quantity: 1, Note: "Spicy"},
+		{Owner: "B", MenuItem: menuItem, ItemName: "Item1", UnitPrice: 80, Quantity: 2, Note: "Spicy"},
+		{Owner: "C", ItemName: "Item2", UnitPrice: 50, Quantity: 1},
+		{Owner: "D", MenuItem: combo, ItemName: "Combo", Choices: "Soup、Tea", UnitPrice: 120, Quantity: 1},
+		{Owner: "E", MenuItem: combo, ItemName: "Combo", Choices: "Soup、Coffee", UnitPrice: 120, Quantity: 1},
+	}
+
+	totals := calculateTotals(reportLinesOf(orderDetails))
+
+	var names []string
+	for _, total := range totals {
+		names = append(names, total.Name)
+	}
+	assert.Equal(t, []string{"Combo (Soup、Coffee)", "Combo (Soup、Tea)", "Item1", "Item2"}, names)
+	assert.Equal(t, 3, totals[2].Quantity)
+	assert.Equal(t, 240, totals[2].Price)
+	assert.Equal(t, []*noteTotal{{Note: "Spicy", Quantity: 3}}, totals[2].Notes)
+	assert.Equal(t, 0, totals[3].Code)
+}
+
+// reportLinesOf takes snapshots of order details, using owners as participant names.
+func reportLinesOf(orderDetails []*models.OrderDetail) []*models.ReportLine {
+	lines := make([]*models.ReportLine, len(orderDetails))
+	for i, od := range orderDetails {
+		lines[i] = newReportLine(od, od.Owner)
+	}
+	return lines
+}
+
+// update rewrites the golden files in testdata with the current output.
+var update = flag.Bool("update", false, "update golden files")
+
+func TestGenerateRestaurantReport(t *testing.T) {
+	menuItems := map[int]*models.MenuItem{
+		1:  {Name: "排骨飯", Code: 1},
+		2:  {Name: "雞腿飯", Code: 2},
+		3:  {Name: "雞腿套餐", Code: 3},
+		12: {Name: "滷蛋", Code: 12},
+	}
+	orderDetails := []*models.OrderDetail{
+		{Owner: "A", MenuItem: menuItems[12], ItemName: "滷蛋", UnitPrice: 15, Quantity: 2},
+		{Owner: "A", MenuItem: menuItems[2], ItemName: "雞腿飯", UnitPrice: 110, Quantity: 1, Note: "不要辣"},
+		{Owner: "B", ItemName: "手寫小菜", UnitPrice: 40, Quantity: 1},
+		{Owner: "B", MenuItem: menuItems[1], ItemName: "排骨飯", UnitPrice: 100, Quantity: 1},
+		{Owner: "C", MenuItem: menuItems[3], ItemName: "雞腿套餐", Choices: "玉米濃湯、紅茶", UnitPrice: 150, Quantity: 1, Note: "去冰"},
+		{Owner: "C", ItemName: "加飯", UnitPrice: 10, Quantity: 1},
+		{Owner: "D", MenuItem: menuItems[2], ItemName: "雞腿飯", UnitPrice: 110, Quantity: 2},
+		{Owner: "D", MenuItem: menuItems[3], ItemName: "雞腿套餐", Choices: "味噌湯、紅茶", UnitPrice: 150, Quantity: 1},
+		{Owner: "E", MenuItem: menuItems[2], ItemName: "雞腿飯", UnitPrice: 110, Quantity: 1, Note: "不要辣"},
+	}
+
+	// Any order of the details gives the same report
+	lines := reportLinesOf(orderDetails)
+	report := generateRestaurantReport(&models.OrderReport{Restaurant: "悟饕池上飯包", Lines: lines})
+	for i := 0; i < 10; i++ {
+		shuffled := append([]*models.ReportLine(nil), lines...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		assert.Equal(t, report, generateRestaurantReport(&models.OrderReport{Restaurant: "悟饕池上飯包", Lines: shuffled}))
+	}
+
+	golden := filepath.Join("testdata", "restaurant_report.golden")
+	if *update {
+		if err := os.WriteFile(golden, []byte(report), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, string(expected), report)
+}
+
+func TestParseOrderItem(t *testing.T) {
+	tests := []struct {
+		spec             string
+		expectedName     string
+		expectedQuantity int
+		expectErr        bool
+	}{
+		{spec: "雞腿飯", expectedName: "雞腿飯", expectedQuantity: 1},
+		{spec: "3", expectedName: "3", expectedQuantity: 1},
+		{spec: "3*2", expectedName: "3", expectedQuantity: 2},
+		{spec: "雞腿飯＊3", expectedName: "雞腿飯", expectedQuantity: 3},
+		{spec: "3*0", expectErr: true},
+		{spec: "3*two", expectErr: true},
+		{spec: "*2", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			name, quantity, err := parseOrderItem(tt.spec)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedName, name)
+			assert.Equal(t, tt.expectedQuantity, quantity)
+		})
+	}
+}
+
+func TestParseItemNote(t *testing.T) {
+	tests := []struct {
+		spec string
+		item string
+		note string
+	}{
+		{"排骨飯", "排骨飯", ""},
+		{"排骨飯*2#不要辣", "排骨飯*2", "不要辣"},
+		{"3 ＃ 飯少 ", "3", "飯少"},
+		{"雞腿套餐:紅茶#去冰#少糖", "雞腿套餐:紅茶", "去冰#少糖"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			item, note := parseItemNote(tt.spec)
+			assert.Equal(t, tt.item, item)
+			assert.Equal(t, tt.note, note)
+		})
+	}
+}
+
+func TestParseItemPrice(t *testing.T) {
+	tests := []struct {
+		spec  string
+		name  string
+		price int
+		found bool
+		err   bool
+	}{
+		{"滷肉飯", "滷肉飯", 0, false, false},
+		{"滷肉飯$40", "滷肉飯", 40, true, false},
+		{"大碗 牛肉麵 ＄ 150", "大碗 牛肉麵", 150, true, false},
+		{"$40", "", 0, true, true},
+		{"滷肉飯$", "", 0, true, true},
+		{"滷肉飯$-5", "", 0, true, true},
+	}
+
+	for _, tt := range tests {
+		name, price, found, err := parseItemPrice(tt.spec)
+		if tt.err {
+			assert.Error(t, err, tt.spec)
+			continue
+		}
+		assert.NoError(t, err, tt.spec)
+		assert.Equal(t, tt.name, name, tt.spec)
+		assert.Equal(t, tt.price, price, tt.spec)
+		assert.Equal(t, tt.found, found, tt.spec)
+	}
+}
+
+func TestCheckManualPrice(t *testing.T) {
+	mockMenuItemRepo := &MockMenuItemRepository{}
+	appHandler := &AppHandler{
+		Logger:       logrus.New(),
+		MenuItemRepo: mockMenuItemRepo,
+	}
+	restaurant := &models.Restaurant{Name: "validRestaurant"}
+	mockMenuItemRepo.On("GetMenuItemByDetails", "雞腿飯", "validRestaurant").Return(&models.MenuItem{Name: "雞腿飯", Price: 120}, nil)
+	mockMenuItemRepo.On("GetMenuItemByDetails", "滷肉飯", "validRestaurant").Return((*models.MenuItem)(nil), gorm.ErrRecordNotFound)
+
+	assert.Equal(t, ErrItemOnMenu, appHandler.checkManualPrice("雞腿飯", restaurant))
+	assert.NoError(t, appHandler.checkManualPrice("滷肉飯", restaurant))
+
+	// Menu photos may list other prices than the menu items
+	withPhotos := &models.Restaurant{Name: "validRestaurant", MenuPhotos: []*models.MenuPhoto{{URL: "https://example.com/menu.jpg"}}}
+	assert.NoError(t, appHandler.checkManualPrice("雞腿飯", withPhotos))
+}
+
+func TestHandleSearchMenuItems(t *testing.T) {
+	mockMenuItemRepo := &MockMenuItemRepository{}
+	appHandler := &AppHandler{
+		Logger:       logrus.New(),
+		Templates:    loadTemplates(t),
+		MenuItemRepo: mockMenuItemRepo,
+	}
+
+	noodles := &models.Restaurant{Model: gorm.Model{ID: 1}, Name: "老王牛肉麵"}
+	bento := &models.Restaurant{Model: gorm.Model{ID: 2}, Name: "池上便當"}
+	mockMenuItemRepo.On("SearchMenuItems", "牛肉", maxSearchResults).Return([]*models.MenuItem{
+		{Name: "紅燒牛肉麵", Price: 160, RestaurantID: 1, Restaurant: noodles},
+		{Name: "清燉牛肉麵", Price: 170, RestaurantID: 1, Restaurant: noodles},
+		{Name: "牛肉燴飯", Price: 110, RestaurantID: 2, Restaurant: bento},
+	}, nil)
+	mockMenuItemRepo.On("SearchMenuItems", "披薩", maxSearchResults).Return([]*models.MenuItem{}, nil)
+
+	t.Run("should group items by restaurant", func(t *testing.T) {
+		container, err := appHandler.handleSearchMenuItems([]string{" 牛肉 "})
+		assert.NoError(t, err)
+
+		// Title, subtitle, then each restaurant followed by its items
+		contents := container.(*linebot.BubbleContainer).Body.Contents
+		assert.Len(t, contents, 2+2+3)
+		assert.Equal(t, "老王牛肉麵", contents[2].(*linebot.BoxComponent).Contents[0].(*linebot.TextComponent).Text)
+		assert.Equal(t, "開/老王牛肉麵", contents[2].(*linebot.BoxComponent).Action.(*linebot.MessageAction).Text)
+		assert.Equal(t, "池上便當", contents[5].(*linebot.BoxComponent).Contents[0].(*linebot.TextComponent).Text)
+	})
+
+	t.Run("should report no results", func(t *testing.T) {
+		_, err := appHandler.handleSearchMenuItems([]string{"披薩"})
+		assert.Equal(t, ErrNoSearchResult, err)
+	})
+}
+
+func TestHandlePickRestaurant(t *testing.T) {
+	newAppHandler := func(restaurants []*models.Restaurant, recentIDs []uint) (*AppHandler, *MockRestaurantRepository) {
+		mockRestaurantRepo := &MockRestaurantRepository{}
+		mockOrderRepo := &MockOrderRepository{}
+		mockMenuItemRepo := &MockMenuItemRepository{}
+		mockTemplateHandler := &MockTemplateHandler{}
+		mockRatingRepo := &MockRatingRepository{}
+
+		mockRatingRepo.On("GetRestaurantRatingSummaries", mock.Anything).Return(map[uint]models.RatingSummary{}, nil)
+		mockRatingRepo.On("GetMenuItemRatingSummaries", mock.Anything).Return(map[uint]models.RatingSummary{}, nil)
+		mockRestaurantRepo.On("GetRestaurantsByTags", []string{"便當"}).Return(restaurants, nil)
+		mockRestaurantRepo.On("IsRestaurantClosedOn", mock.Anything, mock.Anything).Return(false, nil)
+		mockOrderRepo.On("GetRestaurantIDsOrderedSince", mock.Anything).Return(recentIDs, nil)
+		mockMenuItemRepo.On("GetMenuItemsByRestaurantName", mock.Anything).Return([]*models.MenuItem{}, nil)
+		bubbleContainer := &linebot.BubbleContainer{Body: &linebot.BoxComponent{Contents: []linebot.FlexComponent{&linebot.SeparatorComponent{}}}}
+		mockTemplateHandler.On("generateFlexContainer", "menuItemListFlexContainer", mock.Anything).Return(bubbleContainer, nil)
+		mockTemplateHandler.On("generateBoxComponent", "pickFooterBoxComponent", mock.Anything).Return(linebot.BoxComponent{}, nil)
+
+		return &AppHandler{
+			Logger:         logrus.New(),
+			Templates:      mockTemplateHandler,
+			Config:         &config.Config{PickAvoidDays: 3},
+			RestaurantRepo: mockRestaurantRepo,
+			OrderRepo:      mockOrderRepo,
+			MenuItemRepo:   mockMenuItemRepo,
+			RatingRepo:     mockRatingRepo,
+		}, mockRestaurantRepo
+	}
+
+	recentRestaurant := &models.Restaurant{Model: gorm.Model{ID: 1}, Name: "recentRestaurant"}
+	otherRestaurant := &models.Restaurant{Model: gorm.Model{ID: 2}, Name: "otherRestaurant"}
+
+	t.Run("should avoid recently ordered restaurants", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			appHandler, _ := newAppHandler([]*models.Restaurant{recentRestaurant, otherRestaurant}, []uint{1})
+			_, err := appHandler.handlePickRestaurant([]string{"便當"}, "", "")
+			assert.NoError(t, err)
+			appHandler.MenuItemRepo.(*MockMenuItemRepository).AssertCalled(t, "GetMenuItemsByRestaurantName", "otherRestaurant")
+		}
+	})
+
+	t.Run("should fall back to recently ordered restaurants", func(t *testing.T) {
+		appHandler, _ := newAppHandler([]*models.Restaurant{recentRestaurant}, []uint{1})
+		container, err := appHandler.handlePickRestaurant([]string{"便當"}, "", "")
+		assert.NoError(t, err)
+		assert.NotNil(t, container.(*linebot.BubbleContainer).Footer)
+	})
+
+	t.Run("should skip closed restaurants", func(t *testing.T) {
+		appHandler, mockRestaurantRepo := newAppHandler([]*models.Restaurant{otherRestaurant}, []uint{})
+		mockRestaurantRepo.ExpectedCalls = nil
+		mockRestaurantRepo.On("GetRestaurantsByTags", []string{"便當"}).Return([]*models.Restaurant{otherRestaurant}, nil)
+		mockRestaurantRepo.On("IsRestaurantClosedOn", uint(2), mock.Anything).Return(true, nil)
+		_, err := appHandler.handlePickRestaurant([]string{"便當"}, "", "")
+		assert.Equal(t, ErrNoRestaurantToPick, err)
+	})
+}
+
+func TestGenerateMenuFlexContainer(t *testing.T) {
+	mockOrderDetailRepo := &MockOrderDetailRepository{}
+	mockTemplateHandler := &MockTemplateHandler{}
+	mockRatingRepo := &MockRatingRepository{}
+
+	mockRatingRepo.On("GetRestaurantRatingSummaries", mock.Anything).Return(map[uint]models.RatingSummary{}, nil)
+	mockRatingRepo.On("GetMenuItemRatingSummaries", uint(1)).Return(map[uint]models.RatingSummary{}, nil)
+	mockOrderDetailRepo.On("GetPopularMenuItemIDs", uint(1), "group", 3).Return([]uint{10, 11}, nil)
+	mockOrderDetailRepo.On("GetMenuItemIDsOrderedByOwner", uint(1), "user").Return([]uint{10, 12}, nil)
+	bubbleContainer := &linebot.BubbleContainer{Body: &linebot.BoxComponent{Contents: []linebot.FlexComponent{&linebot.SeparatorComponent{}}}}
+	mockTemplateHandler.On("generateFlexContainer", "menuItemListFlexContainer", mock.Anything).Return(bubbleContainer, nil)
+	mockTemplateHandler.On("generateBoxComponent", mock.Anything, mock.Anything).Return(linebot.BoxComponent{}, nil)
+
+	appHandler := &AppHandler{
+		Logger:          logrus.New(),
+		Templates:       mockTemplateHandler,
+		Config:          &config.Config{PopularItemsCount: 3},
+		OrderDetailRepo: mockOrderDetailRepo,
+		RatingRepo:      mockRatingRepo,
+	}
+
+	restaurant := &models.Restaurant{Model: gorm.Model{ID: 1}, Name: "validRestaurant"}
+	menuItems := []*models.MenuItem{
+		{Model: gorm.Model{ID: 10}, Code: 1, Name: "雞腿飯", Price: 100},
+		{Model: gorm.Model{ID: 11}, Code: 2, Name: "排骨飯", Price: 90},
+		{Model: gorm.Model{ID: 12}, Code: 3, Name: "魚排飯", Price: 110},
+		{Model: gorm.Model{ID: 13}, Code: 4, Name: "滷肉飯", Price: 40},
+	}
+	_, err := appHandler.generateMenuFlexContainer(restaurant, menuItems, "user", "group")
+	assert.NoError(t, err)
+
+	mockTemplateHandler.AssertCalled(t, "generateBoxComponent", "restaurantInfoBoxComponent", []interface{}{"標示", "🔥 熱門　🔁 點過"})
+	for _, expected := range []struct {
+		menuItem    *models.MenuItem
+		displayName string
+	}{
+		{menuItems[0], "🔥 🔁 雞腿飯"},
+		{menuItems[1], "🔥 排骨飯"},
+		{menuItems[2], "🔁 魚排飯"},
+		{menuItems[3], "滷肉飯"},
+	} {
+		mockTemplateHandler.AssertCalled(t, "generateBoxComponent", "menuItemListBoxComponent",
+			[]interface{}{expected.menuItem.Code, expected.displayName, expected.menuItem.Price, expected.menuItem.Name, expected.menuItem.Name})
+	}
+}
+
 // ... And so on for other methods ...
 
 // Mocked functions for order repository
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+)
+
+const (
+	// minMatchScore is the lowest score for a name to be considered a match.
+	minMatchScore = 0.45
+	// minSuggestionScore is the lowest score for a name to be suggested to the user.
+	minSuggestionScore = 0.25
+	// maxCandidates limits how many candidates are offered to the user.
+	maxCandidates = 5
+	// maxSuggestions limits how many names are suggested in a reply.
+	maxSuggestions = 3
+)
+
+// variantReplacer folds simplified Chinese and common variant characters on
+// menus into the traditional forms used in this bot.
+var variantReplacer = strings.NewReplacer(
+	"鸡", "雞", "饭", "飯", "面", "麵", "汤", "湯", "猪", "豬", "虾", "蝦",
+	"鱼", "魚", "卤", "滷", "魯", "滷", "酱", "醬", "烧", "燒", "鸭", "鴨",
+	"饺", "餃", "馄", "餛", "饨", "飩", "炖", "燉", "热", "熱", "冻", "凍",
+	"凉", "涼", "绿", "綠", "红", "紅", "乌", "烏", "龙", "龍", "锅", "鍋",
+	"脚", "腳", "线", "線", "咸", "鹹", "鲜", "鮮", "饼", "餅", "寿", "壽",
+	"丝", "絲", "条", "條", "块", "塊", "盐", "鹽", "葱", "蔥", "姜", "薑",
+	"双", "雙", "黄", "黃", "麦", "麥", "荞", "蕎", "贡", "貢", "酿", "釀",
+	"烩", "燴", "韩", "韓", "臺", "台",
+)
+
+// normalizeName folds a name into a canonical form for comparison: full-width
+// characters become half-width, whitespace is removed, letters are lowercased
+// and Chinese variants are folded into their traditional forms.
+func normalizeName(name string) string {
+	folded := strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u3000' || unicode.IsSpace(r):
+			return -1
+		case r >= '\uFF01' && r <= '\uFF5E':
+			// Full-width ASCII variants
+			r -= 0xFEE0
+		}
+		return unicode.ToLower(r)
+	}, name)
+	return variantReplacer.Replace(folded)
+}
+
+// matchScore rates how well query matches name, from 0 (no match) to 1 (same name).
+// Prefix matches rank above substring matches, which rank above names that are
+// only a few edits away.
+func matchScore(query, name string) float64 {
+	query, name = normalizeName(query), normalizeName(name)
+	switch {
+	case query == "" || name == "":
+		return 0
+	case query == name:
+		return 1
+	case strings.HasPrefix(name, query):
+		return 0.9
+	case strings.Contains(name, query):
+		return 0.8
+	}
+
+	maxLen := utf8.RuneCountInString(query)
+	if n := utf8.RuneCountInString(name); n > maxLen {
+		maxLen = n
+	}
+	similarity := 1 - float64(levenshtein(query, name))/float64(maxLen)
+	return similarity * 0.7
+}
+
+// levenshtein returns the edit distance between a and b, counted in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// restaurantMatch is a restaurant together with how well it matched a query.
+type restaurantMatch struct {
+	Restaurant *models.Restaurant
+	Score      float64
+}
+
+// matchRestaurants ranks restaurants by how well their names or aliases match
+// query. A single result is the best match; several results are candidates
+// for the user to choose from.
+func matchRestaurants(query string, restaurants []*models.Restaurant) []*models.Restaurant {
+	var matches []restaurantMatch
+	for _, restaurant := range restaurants {
+		score := matchScore(query, restaurant.Name)
+		for _, alias := range restaurant.Aliases {
+			if s := matchScore(query, alias.Name); s > score {
+				score = s
+			}
+		}
+		if score >= minMatchScore {
+			matches = append(matches, restaurantMatch{Restaurant: restaurant, Score: score})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+
+	// An exact name or alias wins outright
+	if len(matches) > 1 && matches[0].Score == 1 && matches[1].Score < 1 {
+		matches = matches[:1]
+	}
+	if len(matches) > maxCandidates {
+		matches = matches[:maxCandidates]
+	}
+
+	result := make([]*models.Restaurant, len(matches))
+	for i, m := range matches {
+		result[i] = m.Restaurant
+	}
+	return result
+}
+
+// genericWordReplacer removes words that many menu items share, so that
+// suggestions are ranked by what the dish actually is.
+var genericWordReplacer = strings.NewReplacer("便當", "", "套餐", "", "飯", "", "麵", "")
+
+// suggestionScore rates how likely name is what the user meant by query. It is
+// looser than matchScore: names sharing enough characters in any order, such
+// as "雞腿便當" and "香雞腿飯", are still suggested.
+func suggestionScore(query, name string) float64 {
+	score := matchScore(query, name)
+	if dice := runeDice(dishWords(query), dishWords(name)) * 0.6; dice > score {
+		score = dice
+	}
+	return score
+}
+
+// dishWords normalizes name and removes generic words from it, unless nothing would be left.
+func dishWords(name string) string {
+	name = normalizeName(name)
+	if stripped := genericWordReplacer.Replace(name); stripped != "" {
+		return stripped
+	}
+	return name
+}
+
+// runeDice returns the Sørensen–Dice coefficient of the characters in a and b.
+func runeDice(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra)+len(rb) == 0 {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, r := range ra {
+		counts[r]++
+	}
+	common := 0
+	for _, r := range rb {
+		if counts[r] > 0 {
+			counts[r]--
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(ra)+len(rb))
+}
+
+// matchMenuItem finds the menu item meant by query. It returns the item when
+// query names a single item after normalization, or is a prefix or substring of
+// exactly one item; otherwise it returns the names of likely items, best first.
+func matchMenuItem(query string, menuItems []*models.MenuItem) (*models.MenuItem, []string) {
+	var exact, partial []*models.MenuItem
+	type suggestion struct {
+		name  string
+		score float64
+	}
+	var suggestions []suggestion
+	for _, menuItem := range menuItems {
+		switch score := matchScore(query, menuItem.Name); {
+		case score == 1:
+			exact = append(exact, menuItem)
+		case score >= 0.8:
+			partial = append(partial, menuItem)
+		}
+		if score := suggestionScore(query, menuItem.Name); score >= minSuggestionScore {
+			suggestions = append(suggestions, suggestion{name: menuItem.Name, score: score})
+		}
+	}
+
+	if len(exact) == 1 {
+		return exact[0], nil
+	}
+	if len(exact) == 0 && len(partial) == 1 {
+		return partial[0], nil
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].score > suggestions[j].score
+	})
+	var names []string
+	for i := 0; i < len(suggestions) && i < maxSuggestions; i++ {
+		names = append(names, suggestions[i].name)
+	}
+	return nil, names
+}
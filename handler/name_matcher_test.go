@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchRestaurants(t *testing.T) {
+	restaurants := []*models.Restaurant{
+		{Name: "池上便當"},
+		{Name: "池上飯包"},
+		{Name: "八方雲集", Aliases: []*models.RestaurantAlias{{Name: "八方"}}},
+		{Name: "Subway"},
+	}
+
+	names := func(rs []*models.Restaurant) []string {
+		var result []string
+		for _, r := range rs {
+			result = append(result, r.Name)
+		}
+		return result
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{query: "池上便當", expected: []string{"池上便當"}},
+		{query: "池上", expected: []string{"池上便當", "池上飯包"}},
+		{query: "便當", expected: []string{"池上便當"}},
+		{query: "八方", expected: []string{"八方雲集"}},
+		{query: "池上便档", expected: []string{"池上便當"}},
+		{query: "sub way", expected: []string{"Subway"}},
+		{query: "麥當勞", expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.expected, names(matchRestaurants(tt.query, restaurants)))
+		})
+	}
+}
+
+func TestMatchMenuItem(t *testing.T) {
+	menuItems := []*models.MenuItem{
+		{Name: "香雞腿飯"},
+		{Name: "滷肉飯"},
+		{Name: "排骨便當"},
+		{Name: "排骨飯"},
+		{Name: "紅茶 L"},
+	}
+
+	tests := []struct {
+		name                string
+		query               string
+		expectedItem        string
+		expectedSuggestions []string
+	}{
+		{name: "full-width and whitespace", query: "紅茶Ｌ", expectedItem: "紅茶 L"},
+		{name: "simplified characters", query: "卤肉饭", expectedItem: "滷肉飯"},
+		{name: "variant characters", query: "魯肉飯", expectedItem: "滷肉飯"},
+		{name: "missing word", query: "雞腿", expectedItem: "香雞腿飯"},
+		{name: "ambiguous prefix", query: "排骨", expectedSuggestions: []string{"排骨便當", "排骨飯"}},
+		{name: "suggest similar item", query: "雞腿便當", expectedSuggestions: []string{"香雞腿飯", "排骨便當"}},
+		{name: "nothing similar", query: "珍珠奶綠"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			menuItem, suggestions := matchMenuItem(tt.query, menuItems)
+			if tt.expectedItem != "" {
+				if assert.NotNil(t, menuItem) {
+					assert.Equal(t, tt.expectedItem, menuItem.Name)
+				}
+				return
+			}
+			assert.Nil(t, menuItem)
+			assert.Equal(t, tt.expectedSuggestions, suggestions)
+		})
+	}
+}
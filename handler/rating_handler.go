@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+const (
+	// lowRatingThreshold is the average score below which menu items are flagged in the menu.
+	lowRatingThreshold = 2.5
+	// minRatingsToFlag is how many ratings a menu item needs before it can be flagged.
+	minRatingsToFlag = 3
+	// maxRatedItems limits how many menu items are offered for rating after an order.
+	maxRatedItems = 10
+)
+
+// handleRequestRatings replies with buttons for the participants of the active order to rate the restaurant
+// and the items they ordered.
+func (a *AppHandler) handleRequestRatings(args []string, ID string) (linebot.FlexContainer, error) {
+	if len(args) > 1 || args[0] != "" {
+		return nil, ErrInputError
+	}
+
+	order, err := a.getActiveOrderOfIDWithErrorHandling(ID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, ErrNoOrderInProgress
+	}
+	// The restaurant was deleted while ordering
+	if order.Restaurant == nil {
+		return nil, ErrInputError
+	}
+
+	orderDetails, err := a.OrderDetailRepo.GetActiveOrderDetailsByOrderID(order.ID)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單細項", order.ID)
+		return nil, ErrSystemError
+	}
+
+	ratingFlexContainer, err := a.Templates.generateFlexContainer("ratingFlexContainer", order.Restaurant.Name)
+	if err != nil {
+		a.Logger.WithError(err).WithField("File", "ratingFlexContainer").Error("無法解析 JSON")
+		return nil, ErrSystemError
+	}
+	bubbleContainer, ok := ratingFlexContainer.(*linebot.BubbleContainer)
+	if !ok {
+		return nil, ErrSystemError
+	}
+
+	row, err := a.generateRatingRow("餐廳 "+order.Restaurant.Name, order.ID, 0)
+	if err != nil {
+		return nil, err
+	}
+	bubbleContainer.Body.Contents = append(bubbleContainer.Body.Contents, row)
+
+	rated := make(map[uint]bool)
+	for _, od := range orderDetails {
+		if od.MenuItemID == nil || rated[*od.MenuItemID] || len(rated) >= maxRatedItems {
+			continue
+		}
+		rated[*od.MenuItemID] = true
+
+		row, err := a.generateRatingRow(od.ItemName, order.ID, *od.MenuItemID)
+		if err != nil {
+			return nil, err
+		}
+		bubbleContainer.Body.Contents = append(bubbleContainer.Body.Contents, row)
+	}
+
+	return ratingFlexContainer, nil
+}
+
+// generateRatingRow creates a row of buttons scoring from 1 to 5. A menuItemID of zero rates the restaurant.
+func (a *AppHandler) generateRatingRow(label string, orderID, menuItemID uint) (*linebot.BoxComponent, error) {
+	row, err := a.Templates.generateBoxComponent("ratingRowBoxComponent", label)
+	if err != nil {
+		a.Logger.WithError(err).WithField("File", "ratingRowBoxComponent").Error("無法解析 JSON")
+		return nil, ErrSystemError
+	}
+	buttons, ok := row.Contents[len(row.Contents)-1].(*linebot.BoxComponent)
+	if !ok {
+		return nil, ErrSystemError
+	}
+
+	for score := 1; score <= 5; score++ {
+		data := url.Values{
+			"action": {"rate"},
+			"order":  {strconv.FormatUint(uint64(orderID), 10)},
+			"item":   {strconv.FormatUint(uint64(menuItemID), 10)},
+			"score":  {strconv.Itoa(score)},
+		}
+		displayText := fmt.Sprintf("%s %d 分", label, score)
+		button, err := a.Templates.generateBoxComponent("ratingButtonBoxComponent", score, score, data.Encode(), displayText)
+		if err != nil {
+			a.Logger.WithError(err).WithField("File", "ratingButtonBoxComponent").Error("無法解析 JSON")
+			return nil, ErrSystemError
+		}
+		buttons.Contents = append(buttons.Contents, &button)
+	}
+	return &row, nil
+}
+
+// handleRating saves a rating sent by a rating button. Only participants of the order can rate, and only
+// the items that were ordered.
+func (a *AppHandler) handleRating(data url.Values, ID string) (string, error) {
+	orderID, err1 := strconv.ParseUint(data.Get("order"), 10, 0)
+	menuItemID, err2 := strconv.ParseUint(data.Get("item"), 10, 0)
+	score, err3 := strconv.Atoi(data.Get("score"))
+	if err1 != nil || err2 != nil || err3 != nil || score < 1 || score > 5 {
+		return "", ErrInputError
+	}
+
+	order, err := a.OrderRepo.GetOrderByID(uint(orderID))
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單", orderID)
+		return "", ErrSystemError
+	}
+	// Deleted restaurants can no longer be rated
+	if order.Restaurant == nil {
+		return "", ErrInputError
+	}
+	orderDetails, err := a.OrderDetailRepo.GetAllOrderDetailsByOrderID(order.ID)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單細項", order.ID)
+		return "", ErrSystemError
+	}
+
+	participant := order.Owner == ID
+	name := order.Restaurant.Name
+	ordered := menuItemID == 0
+	for _, od := range orderDetails {
+		participant = participant || od.Owner == ID
+		if od.MenuItemID != nil && *od.MenuItemID == uint(menuItemID) {
+			ordered = true
+			name = od.ItemName
+		}
+	}
+	if !participant {
+		return "", ErrNotParticipant
+	}
+	if !ordered {
+		return "", ErrInputError
+	}
+
+	rating := &models.Rating{
+		OrderID:      order.ID,
+		UserID:       ID,
+		MenuItemID:   uint(menuItemID),
+		RestaurantID: order.RestaurantID,
+		Score:        score,
+	}
+	if err := a.RatingRepo.SaveRating(rating); err != nil {
+		a.Logger.WithError(err).WithField("User", a.getDisplayNameFromID(ID)).Errorf("無法儲存 ID %d 訂單的評分", order.ID)
+		return "", ErrSystemError
+	}
+	return fmt.Sprintf("已收到評分: %s %d 分", name, score), nil
+}
+
+// fetchRestaurantRatings returns the rating summaries of restaurants. Ratings are only shown alongside other
+// information, so errors are logged and no ratings are returned.
+func (a *AppHandler) fetchRestaurantRatings(restaurantIDs ...uint) map[uint]models.RatingSummary {
+	summaries, err := a.RatingRepo.GetRestaurantRatingSummaries(restaurantIDs...)
+	if err != nil {
+		a.Logger.WithError(err).Error("無法取得餐廳評分")
+		return nil
+	}
+	return summaries
+}
+
+// fetchMenuItemRatings returns the rating summaries of the menu items of a restaurant, logging errors like
+// fetchRestaurantRatings.
+func (a *AppHandler) fetchMenuItemRatings(restaurantID uint) map[uint]models.RatingSummary {
+	summaries, err := a.RatingRepo.GetMenuItemRatingSummaries(restaurantID)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 ID %d 餐廳的餐點評分", restaurantID)
+		return nil
+	}
+	return summaries
+}
+
+// formatRating renders a rating summary such as "★4.2 (12)", or an empty string without ratings.
+func formatRating(summary models.RatingSummary) string {
+	if summary.Count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("★%.1f (%d)", summary.Average, summary.Count)
+}
+
+// isLowRated reports whether a menu item should be flagged as low-rated in the menu.
+func isLowRated(summary models.RatingSummary) bool {
+	return summary.Count >= minRatingsToFlag && summary.Average < lowRatingThreshold
+}
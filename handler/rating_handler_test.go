@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+)
+
+func TestHandleRating(t *testing.T) {
+	var (
+		appHandler          AppHandler
+		mockOrderRepo       MockOrderRepository
+		mockOrderDetailRepo MockOrderDetailRepository
+		mockRatingRepo      MockRatingRepository
+	)
+
+	appHandler.OrderRepo = &mockOrderRepo
+	appHandler.OrderDetailRepo = &mockOrderDetailRepo
+	appHandler.RatingRepo = &mockRatingRepo
+
+	order := &models.Order{
+		Model:        gorm.Model{ID: 7},
+		Owner:        "owner",
+		RestaurantID: 3,
+		Restaurant:   &models.Restaurant{Name: "validRestaurant"},
+	}
+	mockOrderRepo.On("GetOrderByID", uint(7)).Return(order, nil)
+	menuItemID := uint(11)
+	mockOrderDetailRepo.On("GetAllOrderDetailsByOrderID", uint(7)).Return([]*models.OrderDetail{
+		{Owner: "member", MenuItemID: &menuItemID, ItemName: "雞腿飯"},
+		{Owner: "member", ItemName: "手寫小菜"},
+	}, nil)
+
+	rate := func(item, score string) url.Values {
+		return url.Values{"action": {"rate"}, "order": {"7"}, "item": {item}, "score": {score}}
+	}
+
+	t.Run("should reject invalid scores", func(t *testing.T) {
+		_, err := appHandler.handleRating(rate("0", "6"), "owner")
+		assert.Equal(t, ErrInputError, err)
+	})
+
+	t.Run("should reject users who did not take part in the order", func(t *testing.T) {
+		_, err := appHandler.handleRating(rate("0", "5"), "stranger")
+		assert.Equal(t, ErrNotParticipant, err)
+	})
+
+	t.Run("should reject items that were not ordered", func(t *testing.T) {
+		_, err := appHandler.handleRating(rate("12", "5"), "member")
+		assert.Equal(t, ErrInputError, err)
+	})
+
+	t.Run("should save ratings of ordered items", func(t *testing.T) {
+		mockRatingRepo.On("SaveRating", mock.MatchedBy(func(r *models.Rating) bool {
+			return r.OrderID == 7 && r.UserID == "member" && r.MenuItemID == 11 && r.RestaurantID == 3 && r.Score == 4
+		})).Return(nil).Once()
+		rs, err := appHandler.handleRating(rate("11", "4"), "member")
+		assert.NoError(t, err)
+		assert.Contains(t, rs, "雞腿飯")
+	})
+
+	t.Run("should reject ratings of deleted restaurants", func(t *testing.T) {
+		mockOrderRepo.On("GetOrderByID", uint(8)).Return(&models.Order{Model: gorm.Model{ID: 8}, Owner: "owner", RestaurantID: 3}, nil)
+		_, err := appHandler.handleRating(url.Values{"action": {"rate"}, "order": {"8"}, "item": {"0"}, "score": {"5"}}, "owner")
+		assert.Equal(t, ErrInputError, err)
+	})
+
+	mockRatingRepo.AssertExpectations(t)
+}
@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// reportSheet is a table of a report download. Cells are strings or ints, so that spreadsheets get numbers.
+type reportSheet struct {
+	Name   string
+	Header []string
+	Rows   [][]interface{}
+}
+
+// userReportSheet lists the lines of a report per participant, sorted like the user report page, each followed by
+// the subtotal of the participant and ending with the total.
+func userReportSheet(report *models.OrderReport) *reportSheet {
+	page := newUserReportPage(report)
+	sheet := &reportSheet{
+		Name:   "明細",
+		Header: []string{"參與者", "品項", "備註", "數量", "單價", "小計"},
+	}
+	for _, participant := range page.Participants {
+		for _, line := range participant.Lines {
+			sheet.Rows = append(sheet.Rows, []interface{}{participant.Name, line.Item, line.Note, line.Quantity, line.UnitPrice, line.Subtotal})
+		}
+		sheet.Rows = append(sheet.Rows, []interface{}{participant.Name, "小計", "", participant.Quantity, "", participant.Subtotal})
+	}
+	sheet.Rows = append(sheet.Rows, []interface{}{"總計", "", "", page.Quantity, "", page.Total})
+	return sheet
+}
+
+// chatReportSheets lists the report lines of the orders of a chat by date, and the totals of each participant over
+// all of them. Every order must have its report.
+func chatReportSheets(orders []*models.Order) []*reportSheet {
+	lines := &reportSheet{
+		Name:   "明細",
+		Header: []string{"日期", "餐廳", "參與者", "品項", "備註", "數量", "單價", "小計"},
+	}
+	totals := &reportSheet{
+		Name:   "每人合計",
+		Header: []string{"參與者", "訂單數", "數量", "金額"},
+	}
+
+	type participantTotal struct {
+		orders, quantity, amount int
+	}
+	byParticipant := make(map[string]*participantTotal)
+	quantity, amount := 0, 0
+	for _, order := range orders {
+		date := order.CreatedAt.In(reportLocation).Format("2006-01-02")
+		seen := make(map[string]bool)
+		for _, line := range order.Report.Lines {
+			lines.Rows = append(lines.Rows, []interface{}{date, order.Report.Restaurant, line.Participant, line.Item, line.Note, line.Quantity, line.UnitPrice, line.Subtotal})
+
+			total, ok := byParticipant[line.Participant]
+			if !ok {
+				total = &participantTotal{}
+				byParticipant[line.Participant] = total
+			}
+			if !seen[line.Participant] {
+				seen[line.Participant] = true
+				total.orders++
+			}
+			total.quantity += line.Quantity
+			total.amount += line.Subtotal
+			quantity += line.Quantity
+			amount += line.Subtotal
+		}
+	}
+	lines.Rows = append(lines.Rows, []interface{}{"總計", "", "", "", "", quantity, "", amount})
+
+	names := make([]string, 0, len(byParticipant))
+	for name := range byParticipant {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		total := byParticipant[name]
+		totals.Rows = append(totals.Rows, []interface{}{name, total.orders, total.quantity, total.amount})
+	}
+	totals.Rows = append(totals.Rows, []interface{}{"總計", len(orders), quantity, amount})
+	return []*reportSheet{lines, totals}
+}
+
+// spreadsheetCell keeps a CSV string cell, which may hold a display name, item name or note typed by anyone, from being
+// taken as a formula by spreadsheets, by prefixing it with ' when it starts like one. XLSX cells need no such prefix,
+// as they are written as text.
+func spreadsheetCell(cell interface{}) interface{} {
+	s, ok := cell.(string)
+	if !ok || s == "" {
+		return cell
+	}
+	switch s[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + s
+	}
+	return cell
+}
+
+// encodeReportCSV writes a sheet as CSV, with a BOM so that Excel reads it as UTF-8.
+func encodeReportCSV(w io.Writer, sheet *reportSheet) error {
+	if _, err := io.WriteString(w, utf8BOM); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(sheet.Header); err != nil {
+		return err
+	}
+	for _, row := range sheet.Rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			record[i] = fmt.Sprint(spreadsheetCell(cell))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// encodeReportXLSX writes sheets as an Excel workbook, one worksheet each.
+func encodeReportXLSX(w io.Writer, sheets ...*reportSheet) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	headerStyle, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return fmt.Errorf("failed to create header style: %w", err)
+	}
+	for i, sheet := range sheets {
+		if i == 0 {
+			if err := f.SetSheetName(f.GetSheetName(0), sheet.Name); err != nil {
+				return fmt.Errorf("failed to name sheet %s: %w", sheet.Name, err)
+			}
+		} else if _, err := f.NewSheet(sheet.Name); err != nil {
+			return fmt.Errorf("failed to create sheet %s: %w", sheet.Name, err)
+		}
+
+		header := make([]interface{}, len(sheet.Header))
+		for j, title := range sheet.Header {
+			header[j] = title
+		}
+		for j, row := range append([][]interface{}{header}, sheet.Rows...) {
+			cell, err := excelize.CoordinatesToCellName(1, j+1)
+			if err != nil {
+				return err
+			}
+			if err := f.SetSheetRow(sheet.Name, cell, &row); err != nil {
+				return fmt.Errorf("failed to write sheet %s: %w", sheet.Name, err)
+			}
+		}
+		if err := f.SetRowStyle(sheet.Name, 1, 1, headerStyle); err != nil {
+			return fmt.Errorf("failed to style sheet %s: %w", sheet.Name, err)
+		}
+	}
+	return f.Write(w)
+}
+
+// writeReport replies with sheets as a CSV or XLSX download named name. CSV downloads only contain the first sheet.
+func (a *AppHandler) writeReport(c *gin.Context, name, ext string, sheets ...*reportSheet) {
+	setAttachment(c, "report", name, ext)
+	var err error
+	switch ext {
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		err = encodeReportCSV(c.Writer, sheets[0])
+	case "xlsx":
+		c.Header("Content-Type", xlsxContentType)
+		err = encodeReportXLSX(c.Writer, sheets...)
+	}
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法匯出 %s 報表", name)
+	}
+}
+
+// ExportChatReportsCSVHandler serves the closed orders of a chat in a date range as CSV.
+func (a *AppHandler) ExportChatReportsCSVHandler(c *gin.Context) {
+	a.exportChatReports(c, "csv")
+}
+
+// ExportChatReportsXLSXHandler serves the closed orders of a chat in a date range as XLSX.
+func (a *AppHandler) ExportChatReportsXLSXHandler(c *gin.Context) {
+	a.exportChatReports(c, "xlsx")
+}
+
+// exportChatReports serves the reports of the orders of a chat cleared between the from and to query dates,
+// inclusive. Orders cleared without 統計 are reported from their order details.
+func (a *AppHandler) exportChatReports(c *gin.Context, ext string) {
+	chatID := c.Param("chatID")
+	from, to, err := parseDateRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid date range, use from=YYYY-MM-DD&to=YYYY-MM-DD")
+		return
+	}
+
+	orders, err := a.OrderRepo.GetClosedOrdersOfChatID(chatID, from, to)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 %s 的歷史訂單", chatID)
+		c.String(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	for _, order := range orders {
+		if order.Report != nil {
+			continue
+		}
+		orderDetails, err := a.OrderDetailRepo.GetAllOrderDetailsByOrderID(order.ID)
+		if err != nil {
+			a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單細項", order.ID)
+			c.String(http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		order.Report = a.newOrderReport(order, orderDetails, order.CreatedAt)
+	}
+
+	name := fmt.Sprintf("%s_%s", from.Format("20060102"), to.AddDate(0, 0, -1).Format("20060102"))
+	a.writeReport(c, name, ext, chatReportSheets(orders)...)
+}
+
+// parseDateRange parses the inclusive dates of a range in the report time zone and returns it as [from, to).
+// The range defaults to the current month up to today.
+func parseDateRange(fromString, toString string, now time.Time) (time.Time, time.Time, error) {
+	now = now.In(reportLocation)
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, reportLocation)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, reportLocation)
+	var err error
+	if fromString != "" {
+		if from, err = time.ParseInLocation("2006-01-02", fromString, reportLocation); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if toString != "" {
+		if to, err = time.ParseInLocation("2006-01-02", toString, reportLocation); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("range ends before %s", fromString)
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// handleExportReports replies with signed links to download the closed orders of the chat, e.g.
+// 對帳/2023-05-01/2023-05-31. Without dates the current month is exported.
+func (a *AppHandler) handleExportReports(args []string, chatID string) (string, error) {
+	if len(args) > 2 {
+		return "", ErrInputError
+	}
+	if a.Config.APIToken == "" {
+		return "", ErrAPIDisabled
+	}
+
+	var fromString, toString string
+	if len(args) > 0 {
+		fromString = args[0]
+	}
+	if len(args) > 1 {
+		toString = args[1]
+	}
+	from, to, err := parseDateRange(fromString, toString, time.Now())
+	if err != nil {
+		return "", ErrDateRangeError
+	}
+
+	fromDate, toDate := from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02")
+	expires := time.Now().Add(downloadLinkTTL)
+	basePath := "/api/chats/" + url.PathEscape(chatID) + "/reports"
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s 至 %s 訂單下載 (%d 小時內有效)\n", fromDate, toDate, int(downloadLinkTTL.Hours())))
+	sb.WriteString(fmt.Sprintf("CSV: %s\n", a.signedURL(basePath+".csv", expires, url.Values{"from": {fromDate}, "to": {toDate}})))
+	sb.WriteString(fmt.Sprintf("XLSX: %s\n", a.signedURL(basePath+".xlsx", expires, url.Values{"from": {fromDate}, "to": {toDate}})))
+	return sb.String(), nil
+}
@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/config"
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/image/font/gofont/goregular"
+	"gorm.io/gorm"
+)
+
+func testOrderReport() *models.OrderReport {
+	return &models.OrderReport{
+		Restaurant:  "悟饕池上飯包",
+		GeneratedAt: time.Date(2023, 5, 1, 4, 30, 0, 0, time.UTC),
+		Lines: []*models.ReportLine{
+			{Participant: "小華", Item: "排骨飯", Quantity: 2, UnitPrice: 100, Subtotal: 200},
+			{Participant: "小明", Item: "雞腿飯", Note: "不要辣", Quantity: 1, UnitPrice: 110, Subtotal: 110},
+			{Participant: "小華", Item: "滷蛋", Quantity: 1, UnitPrice: 15, Subtotal: 15},
+		},
+	}
+}
+
+func TestEncodeReportCSV(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, encodeReportCSV(&buf, userReportSheet(testOrderReport())))
+
+	expected := utf8BOM + strings.Join([]string{
+		"參與者,品項,備註,數量,單價,小計",
+		"小明,雞腿飯,不要辣,1,110,110",
+		"小明,小計,,1,,110",
+		"小華,排骨飯,,2,100,200",
+		"小華,滷蛋,,1,15,15",
+		"小華,小計,,3,,215",
+		"總計,,,4,,325",
+	}, "\n") + "\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestSpreadsheetCell(t *testing.T) {
+	assert.Equal(t, `'=HYPERLINK("https://example.com")`, spreadsheetCell(`=HYPERLINK("https://example.com")`))
+	for _, s := range []string{"+cmd|' /C calc'!A0", "-1+1", "@SUM(A1)", "\t=1", "\r=1"} {
+		assert.Equal(t, "'"+s, spreadsheetCell(s), s)
+	}
+	assert.Equal(t, "小明", spreadsheetCell("小明"))
+	assert.Equal(t, "", spreadsheetCell(""))
+	// Amounts stay numbers, negative or not
+	assert.Equal(t, -5, spreadsheetCell(-5))
+}
+
+func TestEncodeReportFormulas(t *testing.T) {
+	report := testOrderReport()
+	report.Lines[1].Participant = "=HYPERLINK(\"https://example.com\",\"小明\")"
+	report.Lines[1].Note = "@SUM(1)"
+
+	var buf bytes.Buffer
+	assert.NoError(t, encodeReportCSV(&buf, userReportSheet(report)))
+	assert.Contains(t, buf.String(), `"'=HYPERLINK(""https://example.com"",""小明"")",雞腿飯,'@SUM(1),1,110,110`)
+
+	buf.Reset()
+	if !assert.NoError(t, encodeReportXLSX(&buf, userReportSheet(report))) {
+		return
+	}
+	f, err := excelize.OpenReader(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	// XLSX cells are text, and read back as typed
+	rows, err := f.GetRows("明細")
+	assert.NoError(t, err)
+	assert.Equal(t, "@SUM(1)", rows[1][2])
+	assert.Equal(t, report.Lines[1].Participant, rows[1][0])
+	formula, err := f.GetCellFormula("明細", "A2")
+	assert.NoError(t, err)
+	assert.Empty(t, formula)
+}
+
+func TestEncodeReportXLSX(t *testing.T) {
+	orders := []*models.Order{
+		{Model: gorm.Model{CreatedAt: time.Date(2023, 5, 1, 3, 0, 0, 0, time.UTC)}, Report: testOrderReport()},
+		{Model: gorm.Model{CreatedAt: time.Date(2023, 5, 2, 3, 0, 0, 0, time.UTC)}, Report: &models.OrderReport{
+			Restaurant: "麥當勞",
+			Lines:      []*models.ReportLine{{Participant: "小明", Item: "大麥克", Quantity: 1, UnitPrice: 75, Subtotal: 75}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, encodeReportXLSX(&buf, chatReportSheets(orders)...)) {
+		return
+	}
+	f, err := excelize.OpenReader(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	assert.Equal(t, []string{"明細", "每人合計"}, f.GetSheetList())
+	rows, err := f.GetRows("明細")
+	assert.NoError(t, err)
+	assert.Len(t, rows, 6)
+	assert.Equal(t, []string{"2023-05-02", "麥當勞", "小明", "大麥克", "", "1", "75", "75"}, rows[4])
+	assert.Equal(t, []string{"總計", "", "", "", "", "5", "", "400"}, rows[5])
+
+	totals, err := f.GetRows("每人合計")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"參與者", "訂單數", "數量", "金額"},
+		{"小明", "2", "2", "185"},
+		{"小華", "1", "3", "215"},
+		{"總計", "2", "5", "400"},
+	}, totals)
+
+	// Amounts are stored as numbers so they can be summed
+	cellType, err := f.GetCellType("明細", "H2")
+	assert.NoError(t, err)
+	assert.NotEqual(t, excelize.CellTypeSharedString, cellType)
+	assert.NotEqual(t, excelize.CellTypeInlineString, cellType)
+}
+
+func TestParseDateRange(t *testing.T) {
+	now := time.Date(2023, 5, 20, 18, 0, 0, 0, time.UTC) // 2023-05-21 02:00 in Taipei
+
+	from, to, err := parseDateRange("", "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 5, 1, 0, 0, 0, 0, reportLocation), from)
+	assert.Equal(t, time.Date(2023, 5, 22, 0, 0, 0, 0, reportLocation), to)
+
+	from, to, err = parseDateRange("2023-04-01", "2023-04-30", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 4, 1, 0, 0, 0, 0, reportLocation), from)
+	assert.Equal(t, time.Date(2023, 5, 1, 0, 0, 0, 0, reportLocation), to)
+
+	_, _, err = parseDateRange("2023-04-30", "2023-04-01", now)
+	assert.Error(t, err)
+	_, _, err = parseDateRange("04/01", "", now)
+	assert.Error(t, err)
+}
+
+func TestReportDownloads(t *testing.T) {
+	var (
+		mockOrderRepo       MockOrderRepository
+		mockOrderDetailRepo MockOrderDetailRepository
+	)
+	appHandler := &AppHandler{
+		Config:          &config.Config{APIToken: "token", PublicBaseURL: "https://example.com"},
+		Logger:          logrus.New(),
+		Templates:       loadTemplates(t),
+		OrderRepo:       &mockOrderRepo,
+		OrderDetailRepo: &mockOrderDetailRepo,
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/userReport/:reportID", appHandler.UserReportHandler)
+	api := r.Group("/api", appHandler.APIAuthMiddleware())
+	api.GET("/chats/:chatID/reports.csv", appHandler.ExportChatReportsCSVHandler)
+
+	mockOrderRepo.On("GetOrderIDByReportID", "abc123").Return(uint(7), nil)
+	mockOrderRepo.On("GetOrderReportByOrderID", uint(7)).Return(testOrderReport(), nil)
+
+	t.Run("should serve a report as CSV", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userReport/abc123.csv", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Header().Get("Content-Disposition"), `filename="report.csv"`)
+		assert.Contains(t, w.Body.String(), "總計,,,4,,325")
+	})
+
+	t.Run("should serve a report as XLSX", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userReport/abc123.xlsx", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, xlsxContentType, w.Header().Get("Content-Type"))
+		_, err := excelize.OpenReader(w.Body)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should reject other formats", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userReport/abc123.pdf", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should export closed orders of a chat with a signed link", func(t *testing.T) {
+		cleared := &models.Order{
+			Model:      gorm.Model{ID: 9, CreatedAt: time.Date(2023, 4, 3, 4, 0, 0, 0, time.UTC)},
+			Restaurant: &models.Restaurant{Name: "麥當勞"},
+		}
+		mockOrderRepo.On("GetClosedOrdersOfChatID", "C123", time.Date(2023, 4, 1, 0, 0, 0, 0, reportLocation), time.Date(2023, 5, 1, 0, 0, 0, 0, reportLocation)).
+			Return([]*models.Order{{Model: gorm.Model{ID: 8, CreatedAt: time.Date(2023, 4, 2, 4, 0, 0, 0, time.UTC)}, Report: testOrderReport()}, cleared}, nil)
+		// Orders cleared without 統計 are reported from their details
+		mockOrderDetailRepo.On("GetAllOrderDetailsByOrderID", uint(9)).Return([]*models.OrderDetail{}, nil)
+
+		reply, err := appHandler.handleExportReports([]string{"2023-04-01", "2023-04-30"}, "C123")
+		assert.NoError(t, err)
+		link := strings.Fields(strings.Split(reply, "\n")[1])[1]
+		assert.True(t, strings.HasPrefix(link, "https://example.com/api/chats/C123/reports.csv?"), link)
+		assert.Contains(t, link, "from=2023-04-01")
+
+		path := link[strings.Index(link, "/api/"):]
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "2023-04-02,悟饕池上飯包,小華,排骨飯,,2,100,200")
+		assert.Contains(t, w.Body.String(), "總計,,,,,4,,325")
+		mockOrderDetailRepo.AssertCalled(t, "GetAllOrderDetailsByOrderID", uint(9))
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/chats/C123/reports.csv?from=2023-04-01", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("should require the API token for 對帳", func(t *testing.T) {
+		disabled := &AppHandler{Config: &config.Config{}}
+		_, err := disabled.handleExportReports(nil, "C123")
+		assert.Equal(t, ErrAPIDisabled, err)
+	})
+}
+
+func TestEncodeReportPDF(t *testing.T) {
+	report := testOrderReport()
+	report.Tel = "02-1234-5678"
+	// Enough lines to break across pages
+	for i := 0; i < 60; i++ {
+		report.Lines = append(report.Lines, &models.ReportLine{
+			Participant: fmt.Sprintf("Member %02d", i),
+			Code:        i%5 + 1,
+			Item:        fmt.Sprintf("Bento %d with a name long enough to wrap within its column of the table", i%5+1),
+			Note:        "less rice",
+			Quantity:    1,
+			UnitPrice:   100,
+			Subtotal:    100,
+		})
+	}
+
+	var buf bytes.Buffer
+	// The Go font lacks CJK glyphs, which are left out
+	assert.NoError(t, encodeReportPDF(&buf, report, goregular.TTF))
+	assert.True(t, bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")))
+	assert.Greater(t, bytes.Count(buf.Bytes(), []byte("/Type /Page\n")), 2)
+
+	assert.Error(t, encodeReportPDF(io.Discard, report, []byte("not a font")))
+}
+
+func TestReportPDFDownload(t *testing.T) {
+	fontPath := filepath.Join(t.TempDir(), "font.ttf")
+	if err := os.WriteFile(fontPath, goregular.TTF, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mockOrderRepo MockOrderRepository
+	appHandler := &AppHandler{
+		Config:    &config.Config{PDFFontPath: fontPath},
+		Logger:    logrus.New(),
+		OrderRepo: &mockOrderRepo,
+	}
+	mockOrderRepo.On("GetOrderIDByReportID", "abc123").Return(uint(7), nil)
+	mockOrderRepo.On("GetOrderReportByOrderID", uint(7)).Return(testOrderReport(), nil)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/userReport/:reportID", appHandler.UserReportHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userReport/abc123.pdf", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), `filename="report.pdf"`)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "%PDF-"))
+
+	appHandler.Config.PDFFontPath = ""
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userReport/abc123.pdf", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
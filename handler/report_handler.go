@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// userReportPage is the view model of userReport.html.
+type userReportPage struct {
+	ReportID     string               `json:"-"`
+	PDF          bool                 `json:"-"`
+	Restaurant   string               `json:"restaurant"`
+	Tel          string               `json:"tel,omitempty"`
+	GeneratedAt  string               `json:"generatedAt"`
+	Participants []*participantReport `json:"participants"`
+	Quantity     int                  `json:"quantity"`
+	Total        int                  `json:"total"`
+}
+
+// participantReport is the table of a participant on the user report page.
+type participantReport struct {
+	Name     string               `json:"name"`
+	Lines    []*models.ReportLine `json:"lines"`
+	Quantity int                  `json:"quantity"`
+	Subtotal int                  `json:"subtotal"`
+}
+
+// newUserReportPage groups the lines of a report by participant, sorted by name. The lines of a participant keep the
+// order they were ordered in, and the total is the sum of the same lines as the restaurant report.
+func newUserReportPage(report *models.OrderReport) *userReportPage {
+	page := &userReportPage{
+		Restaurant:  report.Restaurant,
+		Tel:         report.Tel,
+		GeneratedAt: report.GeneratedAt.In(reportLocation).Format("2006-01-02 15:04"),
+	}
+	participants := make(map[string]*participantReport)
+	for _, line := range report.Lines {
+		participant, ok := participants[line.Participant]
+		if !ok {
+			participant = &participantReport{Name: line.Participant}
+			participants[line.Participant] = participant
+			page.Participants = append(page.Participants, participant)
+		}
+		participant.Lines = append(participant.Lines, line)
+		participant.Quantity += line.Quantity
+		participant.Subtotal += line.Subtotal
+		page.Quantity += line.Quantity
+		page.Total += line.Subtotal
+	}
+	sort.SliceStable(page.Participants, func(i, j int) bool {
+		return page.Participants[i].Name < page.Participants[j].Name
+	})
+	return page
+}
+
+// reportLocation is the time zone report times are shown in.
+var reportLocation = time.FixedZone("Asia/Taipei", 8*60*60)
+
+// UserReportHandler serves the user report of an order as an HTML page, or as a download when the report ID ends
+// with .csv, .xlsx or .pdf.
+func (a *AppHandler) UserReportHandler(c *gin.Context) {
+	reportID := c.Param("reportID")
+	ext := strings.TrimPrefix(path.Ext(reportID), ".")
+	switch ext {
+	case "":
+	case "csv", "xlsx", "pdf":
+		reportID = strings.TrimSuffix(reportID, "."+ext)
+	default:
+		c.String(http.StatusNotFound, "Report not found")
+		return
+	}
+
+	// Look up the orderID of ReportID in the db
+	orderID, err := a.OrderRepo.GetOrderIDByReportID(reportID)
+	if err != nil {
+		c.String(http.StatusNotFound, "Report not found")
+		a.Logger.WithError(err).Errorf("無法取得 %s 報表對應的訂單", reportID)
+		return
+	}
+
+	report, err := a.OrderRepo.GetOrderReportByOrderID(orderID)
+	if err != nil {
+		c.String(http.StatusNotFound, "Report not found")
+		a.Logger.WithError(err).Errorf("無法取得 %s 報表", reportID)
+		return
+	}
+
+	name := fmt.Sprintf("%s_%s", report.Restaurant, report.GeneratedAt.In(reportLocation).Format("20060102"))
+	switch ext {
+	case "pdf":
+		a.writeReportPDF(c, name, report)
+		return
+	case "csv", "xlsx":
+		a.writeReport(c, name, ext, userReportSheet(report))
+		return
+	}
+
+	// Render into a buffer so a failed template does not leave a partial page
+	page := newUserReportPage(report)
+	page.ReportID = reportID
+	page.PDF = a.Config.PDFFontPath != ""
+	var buf bytes.Buffer
+	if err := a.Templates.renderHTML(&buf, "userReport.html", page); err != nil {
+		c.String(http.StatusInternalServerError, "Could not render report")
+		a.Logger.WithError(err).Errorf("無法產生 %s 報表頁面", reportID)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// writeReportPDF replies with a report as a PDF download, rendered into a buffer so that failures can still be
+// reported.
+func (a *AppHandler) writeReportPDF(c *gin.Context, name string, report *models.OrderReport) {
+	if a.Config.PDFFontPath == "" {
+		c.String(http.StatusNotFound, "PDF reports are disabled")
+		return
+	}
+	font, err := os.ReadFile(a.Config.PDFFontPath)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法讀取 PDF 字型 %s", a.Config.PDFFontPath)
+		c.String(http.StatusInternalServerError, "Could not render report")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := encodeReportPDF(&buf, report, font); err != nil {
+		a.Logger.WithError(err).Errorf("無法產生 %s PDF 報表", name)
+		c.String(http.StatusInternalServerError, "Could not render report")
+		return
+	}
+	setAttachment(c, "report", name, "pdf")
+	c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+}
+
+// handleRevokeReport breaks the link to the live page and report of an order, e.g. 撤銷/<report ID> or
+// 撤銷/<link>, which splits into several arguments ending with the report ID. Only the owner of the order or
+// members of the chat it was opened in can revoke its link.
+func (a *AppHandler) handleRevokeReport(args []string, ID string, chatID string) (string, error) {
+	if len(args) == 0 {
+		return "", ErrInputError
+	}
+	reportID := args[len(args)-1]
+	reportID = strings.TrimSuffix(reportID, path.Ext(reportID))
+	if reportID == "" {
+		return "", ErrInputError
+	}
+
+	orderID, err := a.OrderRepo.GetOrderIDByReportID(reportID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrReportNotFound
+	} else if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 %s 報表對應的訂單", reportID)
+		return "", ErrSystemError
+	}
+	order, err := a.OrderRepo.GetOrderByID(orderID)
+	if err != nil {
+		a.Logger.WithError(err).Errorf("無法取得 ID %d 的訂單", orderID)
+		return "", ErrSystemError
+	}
+	if order.Owner != ID && order.ChatID != chatID {
+		// Links of other chats are not revealed to exist
+		return "", ErrReportNotFound
+	}
+
+	if err := a.OrderRepo.RevokeReportID(orderID); err != nil {
+		a.Logger.WithError(err).Errorf("無法撤銷 ID %d 的報表連結", orderID)
+		return "", ErrSystemError
+	}
+	// Close the live pages following the revoked link
+	a.orderEvents.publish(orderID)
+	return "已撤銷報表連結，統計可取得新連結", nil
+}
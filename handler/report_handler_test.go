@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/config"
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/gin-gonic/gin"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+)
+
+func TestUserReportHandler(t *testing.T) {
+	var mockOrderRepo MockOrderRepository
+	appHandler := &AppHandler{
+		Config:    &config.Config{},
+		Logger:    logrus.New(),
+		Templates: loadTemplates(t),
+		OrderRepo: &mockOrderRepo,
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/userReport/:reportID", appHandler.UserReportHandler)
+
+	report := &models.OrderReport{
+		Restaurant:  "悟饕池上飯包",
+		Tel:         "02-1234-5678",
+		GeneratedAt: time.Date(2023, 5, 1, 4, 30, 0, 0, time.UTC),
+		Lines: []*models.ReportLine{
+			{Participant: "<script>alert(1)</script>", Item: "排骨飯", Quantity: 2, UnitPrice: 100, Subtotal: 200},
+			{Participant: "小明", Item: "雞腿飯 (紅茶)", Note: "<b>少冰</b>", Quantity: 1, UnitPrice: 1250, Subtotal: 1250},
+			{Participant: "<script>alert(1)</script>", Item: "滷蛋", Quantity: 1, UnitPrice: 15, Subtotal: 15},
+		},
+	}
+	mockOrderRepo.On("GetOrderIDByReportID", "abc123").Return(uint(7), nil)
+	mockOrderRepo.On("GetOrderReportByOrderID", uint(7)).Return(report, nil)
+	mockOrderRepo.On("GetOrderIDByReportID", "missing").Return(uint(0), gorm.ErrRecordNotFound)
+
+	t.Run("should render the report with display names escaped", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userReport/abc123", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		body := w.Body.String()
+		assert.NotContains(t, body, "<script>alert(1)</script>")
+		assert.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+		assert.Contains(t, body, "備註：&lt;b&gt;少冰&lt;/b&gt;")
+		assert.Contains(t, body, "悟饕池上飯包")
+		assert.Contains(t, body, "2023-05-01 12:30")
+		assert.Contains(t, body, "1,250")
+		assert.Contains(t, body, "1,465 元")
+	})
+
+	t.Run("should serve the report of a cleared order", func(t *testing.T) {
+		// Report IDs of cleared orders are still looked up, until they expire
+		mockOrderRepo.On("GetOrderIDByReportID", "cleared").Return(uint(8), nil)
+		mockOrderRepo.On("GetOrderReportByOrderID", uint(8)).Return(report, nil)
+		for _, path := range []string{"/userReport/cleared", "/userReport/cleared.csv"} {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusOK, w.Code, path)
+			assert.Contains(t, w.Body.String(), "排骨飯", path)
+		}
+	})
+
+	t.Run("should respond not found for unknown reports", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userReport/missing", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestNewUserReportPage(t *testing.T) {
+	page := newUserReportPage(&models.OrderReport{
+		Restaurant: "validRestaurant",
+		Lines: []*models.ReportLine{
+			{Participant: "B", Item: "排骨飯", Quantity: 2, UnitPrice: 100, Subtotal: 200},
+			{Participant: "A", Item: "雞腿飯", Note: "不要辣", Quantity: 1, UnitPrice: 120, Subtotal: 120},
+			{Participant: "B", Item: "滷蛋", Quantity: 1, UnitPrice: 15, Subtotal: 15},
+		},
+	})
+
+	if assert.Len(t, page.Participants, 2) {
+		assert.Equal(t, "A", page.Participants[0].Name)
+		assert.Equal(t, 120, page.Participants[0].Subtotal)
+		assert.Equal(t, "B", page.Participants[1].Name)
+		if assert.Len(t, page.Participants[1].Lines, 2) {
+			assert.Equal(t, "排骨飯", page.Participants[1].Lines[0].Item)
+			assert.Equal(t, "滷蛋", page.Participants[1].Lines[1].Item)
+		}
+		assert.Equal(t, 3, page.Participants[1].Quantity)
+		assert.Equal(t, 215, page.Participants[1].Subtotal)
+	}
+	assert.Equal(t, 4, page.Quantity)
+	assert.Equal(t, 335, page.Total)
+}
+
+func TestGenerateStatisticFlexContainer(t *testing.T) {
+	appHandler := &AppHandler{Logger: logrus.New(), Templates: loadTemplates(t)}
+	report := &models.OrderReport{
+		Restaurant: "悟饕池上飯包",
+		Tel:        "(02) 1234-5678 #12",
+		Lines: []*models.ReportLine{
+			{Participant: `小"華`, Code: 2, Item: "雞腿飯", Note: "不要辣", Quantity: 2, UnitPrice: 110, Subtotal: 220},
+			{Participant: "小明", Code: 1, Item: "排骨飯", Quantity: 1, UnitPrice: 1000, Subtotal: 1000},
+		},
+	}
+
+	container, err := appHandler.generateStatisticFlexContainer(report, "https://example.com/userReport/abc123")
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := json.Marshal(container)
+	assert.NoError(t, err)
+	body := string(data)
+	assert.Contains(t, body, "共 3 份 / 1,220 元")
+	assert.Less(t, strings.Index(body, "1. 排骨飯"), strings.Index(body, "2. 雞腿飯"))
+	assert.Contains(t, body, "備註: 不要辣")
+	assert.Contains(t, body, `小\"華`)
+	assert.Contains(t, body, "1,000 元")
+	assert.Contains(t, body, `"uri":"https://example.com/userReport/abc123"`)
+	assert.Contains(t, body, `"uri":"tel:021234-5678"`)
+
+	report.Tel = ""
+	container, err = appHandler.generateStatisticFlexContainer(report, "https://example.com/userReport/abc123")
+	assert.NoError(t, err)
+	assert.Len(t, container.(*linebot.BubbleContainer).Footer.Contents, 1)
+
+	t.Run("should cut a large order short", func(t *testing.T) {
+		large := &models.OrderReport{Restaurant: "悟饕池上飯包"}
+		for i := 1; i <= 100; i++ {
+			large.Lines = append(large.Lines, &models.ReportLine{
+				Participant: fmt.Sprintf("成員%03d", i),
+				Code:        i,
+				Item:        fmt.Sprintf("便當%d", i),
+				Note:        "不要辣",
+				Quantity:    1,
+				UnitPrice:   100,
+				Subtotal:    100,
+			})
+		}
+		container, err := appHandler.generateStatisticFlexContainer(large, "https://example.com/userReport/abc123")
+		if !assert.NoError(t, err) {
+			return
+		}
+		data, err := json.Marshal(container)
+		assert.NoError(t, err)
+		body := string(data)
+		// Each item takes a row and a note row
+		assert.Contains(t, body, "…及其他 85 項")
+		assert.Contains(t, body, "…及其他 80 人")
+		assert.NotContains(t, body, "便當16")
+		assert.Contains(t, body, "共 100 份 / 10,000 元")
+		// LINE rejects bubbles over 30 KB
+		assert.Less(t, len(data), 30*1024)
+	})
+}
+
+func TestTelURINumber(t *testing.T) {
+	assert.Equal(t, "02-1234-5678", telURINumber("02-1234-5678"))
+	assert.Equal(t, "+886212345678", telURINumber("+886 2 1234 5678"))
+	assert.Equal(t, "0212345678", telURINumber("(02)12345678 #3"))
+	assert.Equal(t, "", telURINumber("無"))
+}
+
+func TestHandleRevokeReport(t *testing.T) {
+	var mockOrderRepo MockOrderRepository
+	appHandler := &AppHandler{
+		Logger:    logrus.New(),
+		OrderRepo: &mockOrderRepo,
+	}
+	mockOrderRepo.On("GetOrderIDByReportID", "abc123").Return(uint(7), nil)
+	mockOrderRepo.On("GetOrderIDByReportID", "missing").Return(uint(0), gorm.ErrRecordNotFound)
+	mockOrderRepo.On("GetOrderByID", uint(7)).Return(&models.Order{Model: gorm.Model{ID: 7}, Owner: "U1", ChatID: "C1"}, nil)
+	mockOrderRepo.On("RevokeReportID", uint(7)).Return(nil)
+
+	t.Run("should revoke a link pasted into the chat of the order", func(t *testing.T) {
+		changes, unsubscribe := appHandler.orderEvents.subscribe(7)
+		defer unsubscribe()
+
+		// 撤銷/https://example.com:443/userReport/abc123.pdf
+		_, err := appHandler.handleRevokeReport([]string{"https:", "", "example.com:443", "userReport", "abc123.pdf"}, "U2", "C1")
+		assert.NoError(t, err)
+		mockOrderRepo.AssertCalled(t, "RevokeReportID", uint(7))
+		assert.Len(t, changes, 1)
+	})
+
+	t.Run("should not reveal links of other chats", func(t *testing.T) {
+		_, err := appHandler.handleRevokeReport([]string{"abc123"}, "U2", "C2")
+		assert.Equal(t, ErrReportNotFound, err)
+		_, err = appHandler.handleRevokeReport([]string{"missing"}, "U1", "C1")
+		assert.Equal(t, ErrReportNotFound, err)
+		mockOrderRepo.AssertNumberOfCalls(t, "RevokeReportID", 1)
+	})
+
+	t.Run("should require a link", func(t *testing.T) {
+		_, err := appHandler.handleRevokeReport([]string{""}, "U1", "C1")
+		assert.Equal(t, ErrInputError, err)
+	})
+}
+
+func TestMigrateLegacyReports(t *testing.T) {
+	var (
+		mockOrderRepo       MockOrderRepository
+		mockOrderDetailRepo MockOrderDetailRepository
+	)
+	appHandler := &AppHandler{
+		Logger:          logrus.New(),
+		Bot:             newProfileBot(t),
+		OrderRepo:       &mockOrderRepo,
+		OrderDetailRepo: &mockOrderDetailRepo,
+	}
+	savedAt := time.Date(2023, 5, 1, 4, 30, 0, 0, time.UTC)
+	mockOrderRepo.On("GetOrderIDsWithLegacyReport").Return([]uint{7}, nil)
+	mockOrderRepo.On("GetOrderByID", uint(7)).Return(&models.Order{
+		Model:      gorm.Model{ID: 7, UpdatedAt: savedAt, DeletedAt: gorm.DeletedAt{Time: savedAt, Valid: true}},
+		Restaurant: &models.Restaurant{Name: "悟饕池上飯包"},
+	}, nil)
+	mockOrderDetailRepo.On("GetAllOrderDetailsByOrderID", uint(7)).Return([]*models.OrderDetail{
+		{Owner: "小明", ItemName: "排骨飯", Quantity: 2, UnitPrice: 100},
+	}, nil)
+	mockOrderRepo.On("SaveLegacyReport", uint(7), &models.OrderReport{
+		Restaurant:  "悟饕池上飯包",
+		GeneratedAt: savedAt,
+		Lines:       []*models.ReportLine{{Participant: "小明", Item: "排骨飯", Quantity: 2, UnitPrice: 100, Subtotal: 200}},
+	}).Return(nil)
+	mockOrderRepo.On("DropLegacyReports").Return(nil)
+
+	appHandler.migrateLegacyReports()
+	mockOrderRepo.AssertExpectations(t)
+
+	t.Run("should keep the HTML reports if rebuilding fails", func(t *testing.T) {
+		var failingOrderRepo MockOrderRepository
+		appHandler.OrderRepo = &failingOrderRepo
+		failingOrderRepo.On("GetOrderIDsWithLegacyReport").Return([]uint{8}, nil)
+		failingOrderRepo.On("GetOrderByID", uint(8)).Return(nil, gorm.ErrRecordNotFound)
+
+		appHandler.migrateLegacyReports()
+		failingOrderRepo.AssertNotCalled(t, "DropLegacyReports")
+	})
+
+	t.Run("should keep the HTML reports if a participant name cannot be looked up", func(t *testing.T) {
+		var failingOrderRepo MockOrderRepository
+		appHandler.OrderRepo = &failingOrderRepo
+		appHandler.Bot = newBot(t, http.NotFoundHandler())
+		appHandler.displayNames = displayNames{}
+		failingOrderRepo.On("GetOrderIDsWithLegacyReport").Return([]uint{7}, nil)
+		failingOrderRepo.On("GetOrderByID", uint(7)).Return(&models.Order{Model: gorm.Model{ID: 7}}, nil)
+
+		appHandler.migrateLegacyReports()
+		failingOrderRepo.AssertNotCalled(t, "SaveLegacyReport", mock.Anything, mock.Anything)
+		failingOrderRepo.AssertNotCalled(t, "DropLegacyReports")
+	})
+}
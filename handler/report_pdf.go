@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/signintech/gopdf"
+)
+
+const (
+	pdfFontFamily = "report"
+	pdfMargin     = 40.0
+	pdfLineHeight = 16.0
+	pdfFontSize   = 11.0
+)
+
+// pdfColumn is a column of a table in a PDF report. Align is gopdf.Left or gopdf.Right.
+type pdfColumn struct {
+	Title string
+	Width float64
+	Align int
+}
+
+var (
+	// summaryColumns are the columns of the restaurant summary, 515pt wide to fit A4 within the margins.
+	summaryColumns = []pdfColumn{{"品項", 335, gopdf.Left}, {"數量", 80, gopdf.Right}, {"金額", 100, gopdf.Right}}
+	// breakdownColumns are the columns of the per-person breakdown.
+	breakdownColumns = []pdfColumn{{"品項", 255, gopdf.Left}, {"單價", 80, gopdf.Right}, {"數量", 80, gopdf.Right}, {"小計", 100, gopdf.Right}}
+)
+
+// pdfWriter lays out lines of text and tables top to bottom on A4 pages, starting new pages as needed.
+type pdfWriter struct {
+	pdf *gopdf.GoPdf
+	y   float64
+}
+
+// newPDFWriter starts a document with font, a TrueType font that is embedded as a subset of the glyphs used.
+// Characters missing from the font are left out rather than failing the report.
+func newPDFWriter(font []byte) (*pdfWriter, error) {
+	pdf := &gopdf.GoPdf{}
+	pdf.Start(gopdf.Config{PageSize: *gopdf.PageSizeA4})
+	if err := pdf.AddTTFFontDataWithOption(pdfFontFamily, font, gopdf.TtfOption{OnGlyphNotFound: func(rune) {}}); err != nil {
+		return nil, fmt.Errorf("failed to load PDF font: %w", err)
+	}
+	w := &pdfWriter{pdf: pdf}
+	w.newPage()
+	return w, nil
+}
+
+func (w *pdfWriter) newPage() {
+	w.pdf.AddPage()
+	w.y = pdfMargin
+}
+
+// ensure starts a new page unless height fits on the current one.
+func (w *pdfWriter) ensure(height float64) {
+	if w.y+height > gopdf.PageSizeA4.H-pdfMargin {
+		w.newPage()
+	}
+}
+
+// text writes a line of text in the given font size.
+func (w *pdfWriter) text(text string, size float64) error {
+	if err := w.pdf.SetFont(pdfFontFamily, "", size); err != nil {
+		return err
+	}
+	height := size * 1.5
+	w.ensure(height)
+	w.pdf.SetXY(pdfMargin, w.y)
+	if err := w.pdf.Cell(&gopdf.Rect{W: gopdf.PageSizeA4.W - 2*pdfMargin, H: height}, text); err != nil {
+		return err
+	}
+	w.y += height
+	return nil
+}
+
+// row writes a table row, wrapping cells that do not fit their column.
+func (w *pdfWriter) row(columns []pdfColumn, cells ...string) error {
+	if err := w.pdf.SetFont(pdfFontFamily, "", pdfFontSize); err != nil {
+		return err
+	}
+	wrapped := make([][]string, len(cells))
+	lines := 1
+	for i, cell := range cells {
+		wrapped[i] = []string{cell}
+		if cell != "" {
+			split, err := w.pdf.SplitText(cell, columns[i].Width-4)
+			if err != nil {
+				return err
+			}
+			wrapped[i] = split
+		}
+		if len(wrapped[i]) > lines {
+			lines = len(wrapped[i])
+		}
+	}
+
+	w.ensure(float64(lines) * pdfLineHeight)
+	x := pdfMargin
+	for i, column := range columns {
+		for j, line := range wrapped[i] {
+			w.pdf.SetXY(x, w.y+float64(j)*pdfLineHeight)
+			rect := &gopdf.Rect{W: column.Width - 4, H: pdfLineHeight}
+			if err := w.pdf.CellWithOption(rect, line, gopdf.CellOption{Align: column.Align | gopdf.Middle}); err != nil {
+				return err
+			}
+		}
+		x += column.Width
+	}
+	w.y += float64(lines) * pdfLineHeight
+	return nil
+}
+
+// header writes the titles of columns above a rule.
+func (w *pdfWriter) header(columns []pdfColumn) error {
+	titles := make([]string, len(columns))
+	for i, column := range columns {
+		titles[i] = column.Title
+	}
+	w.ensure(2 * pdfLineHeight)
+	if err := w.row(columns, titles...); err != nil {
+		return err
+	}
+	w.rule()
+	return nil
+}
+
+// rule draws a horizontal line across the page.
+func (w *pdfWriter) rule() {
+	w.pdf.SetLineWidth(0.5)
+	w.pdf.Line(pdfMargin, w.y+2, gopdf.PageSizeA4.W-pdfMargin, w.y+2)
+	w.y += 4
+}
+
+// encodeReportPDF writes a report as a printable PDF: the restaurant summary on the first page, for faxing or
+// reading out, followed by the breakdown per person.
+func encodeReportPDF(out io.Writer, report *models.OrderReport, font []byte) error {
+	w, err := newPDFWriter(font)
+	if err != nil {
+		return err
+	}
+
+	page := newUserReportPage(report)
+	if err := writeReportHeading(w, page, "訂購單"); err != nil {
+		return err
+	}
+	if err := w.header(summaryColumns); err != nil {
+		return err
+	}
+	for _, total := range calculateTotals(report.Lines) {
+		name := total.Name
+		if total.Code != 0 {
+			name = fmt.Sprintf("%d. %s", total.Code, total.Name)
+		}
+		if err := w.row(summaryColumns, name, strconv.Itoa(total.Quantity), formatPrice(total.Price)); err != nil {
+			return err
+		}
+		for _, note := range total.Notes {
+			if err := w.row(summaryColumns, "　備註: "+note.Note, strconv.Itoa(note.Quantity), ""); err != nil {
+				return err
+			}
+		}
+	}
+	w.rule()
+	if err := w.row(summaryColumns, "總計", strconv.Itoa(page.Quantity), formatPrice(page.Total)+" 元"); err != nil {
+		return err
+	}
+
+	w.newPage()
+	if err := writeReportHeading(w, page, "分帳明細"); err != nil {
+		return err
+	}
+	for _, participant := range page.Participants {
+		w.ensure(4 * pdfLineHeight)
+		w.y += pdfLineHeight / 2
+		if err := w.text(participant.Name, 13); err != nil {
+			return err
+		}
+		if err := w.header(breakdownColumns); err != nil {
+			return err
+		}
+		for _, line := range participant.Lines {
+			item := line.Item
+			if line.Note != "" {
+				item += " (備註: " + line.Note + ")"
+			}
+			if err := w.row(breakdownColumns, item, formatPrice(line.UnitPrice), strconv.Itoa(line.Quantity), formatPrice(line.Subtotal)); err != nil {
+				return err
+			}
+		}
+		if err := w.row(breakdownColumns, "小計", "", strconv.Itoa(participant.Quantity), formatPrice(participant.Subtotal)+" 元"); err != nil {
+			return err
+		}
+	}
+	w.y += pdfLineHeight / 2
+	w.rule()
+	if err := w.row(breakdownColumns, "總計", "", strconv.Itoa(page.Quantity), formatPrice(page.Total)+" 元"); err != nil {
+		return err
+	}
+
+	if _, err := w.pdf.WriteTo(out); err != nil {
+		return fmt.Errorf("failed to write PDF: %w", err)
+	}
+	return nil
+}
+
+// writeReportHeading writes the restaurant, its phone number and the report time at the top of a page.
+func writeReportHeading(w *pdfWriter, page *userReportPage, title string) error {
+	if err := w.text(fmt.Sprintf("%s %s", page.Restaurant, title), 18); err != nil {
+		return err
+	}
+	if page.Tel != "" {
+		if err := w.text("電話: "+page.Tel, pdfFontSize); err != nil {
+			return err
+		}
+	}
+	if err := w.text("統計時間: "+page.GeneratedAt, pdfFontSize); err != nil {
+		return err
+	}
+	w.y += pdfLineHeight / 2
+	return nil
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+)
+
+// weekdayNames maps time.Weekday to its Chinese short name.
+var weekdayNames = [...]string{"日", "一", "二", "三", "四", "五", "六"}
+
+// parseOpeningHours parses weekly opening hours such as
+// "1-5 11:00-14:00 17:00-20:00;6 11:00-13:00". Days are numbered 1 (Monday)
+// to 7 (Sunday) and may be given as a range ("1-5") or a list ("1、3、5").
+// An empty string yields no opening hours.
+func parseOpeningHours(s string) ([]*models.OpeningHour, error) {
+	var hours []*models.OpeningHour
+	s = strings.ReplaceAll(s, "；", ";")
+	for _, spec := range strings.Split(s, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing opening periods in %q", spec)
+		}
+
+		weekdays, err := parseWeekdays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, period := range fields[1:] {
+			opens, closes, ok := strings.Cut(period, "-")
+			if !ok {
+				return nil, fmt.Errorf("invalid opening period %q", period)
+			}
+			if opens, err = normalizeClock(opens); err != nil {
+				return nil, err
+			}
+			if closes, err = normalizeClock(closes); err != nil {
+				return nil, err
+			}
+			if opens >= closes {
+				return nil, fmt.Errorf("opening period %q ends before it starts", period)
+			}
+			for _, weekday := range weekdays {
+				hours = append(hours, &models.OpeningHour{Weekday: weekday, Opens: opens, Closes: closes})
+			}
+		}
+	}
+	return hours, nil
+}
+
+// parseWeekdays parses a day specification like "1-5" or "1、3、5".
+func parseWeekdays(s string) ([]time.Weekday, error) {
+	var weekdays []time.Weekday
+	for _, part := range strings.Split(s, "、") {
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		first, err := parseWeekday(from)
+		if err != nil {
+			return nil, err
+		}
+		last, err := parseWeekday(to)
+		if err != nil {
+			return nil, err
+		}
+		if last < first {
+			return nil, fmt.Errorf("invalid weekday range %q", part)
+		}
+		for day := first; day <= last; day++ {
+			weekdays = append(weekdays, time.Weekday(day%7))
+		}
+	}
+	return weekdays, nil
+}
+
+// parseWeekday parses a day number from 1 (Monday) to 7 (Sunday).
+func parseWeekday(s string) (int, error) {
+	day, err := strconv.Atoi(s)
+	if err != nil || day < 1 || day > 7 {
+		return 0, fmt.Errorf("invalid weekday %q", s)
+	}
+	return day, nil
+}
+
+// normalizeClock validates a time of day and formats it as "HH:MM".
+func normalizeClock(s string) (string, error) {
+	hour, minute, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hour)
+	if err != nil || h < 0 || h > 24 {
+		return "", fmt.Errorf("invalid time %q", s)
+	}
+	m, err := strconv.Atoi(minute)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return "", fmt.Errorf("invalid time %q", s)
+	}
+	return fmt.Sprintf("%02d:%02d", h, m), nil
+}
+
+// formatOpeningHours renders opening hours for display, grouping consecutive
+// days that share the same periods, e.g. "一至五 11:00-14:00、17:00-20:00；六 11:00-13:00".
+func formatOpeningHours(hours []*models.OpeningHour) string {
+	periods := make(map[time.Weekday][]string)
+	for _, h := range hours {
+		periods[h.Weekday] = append(periods[h.Weekday], h.Opens+"-"+h.Closes)
+	}
+
+	// Walk the week starting from Monday
+	week := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+	var groups []string
+	for i := 0; i < len(week); {
+		current := strings.Join(periods[week[i]], "、")
+		j := i + 1
+		for j < len(week) && strings.Join(periods[week[j]], "、") == current {
+			j++
+		}
+		if current != "" {
+			days := weekdayNames[week[i]]
+			if j-i > 1 {
+				days += "至" + weekdayNames[week[j-1]]
+			}
+			groups = append(groups, days+" "+current)
+		}
+		i = j
+	}
+	return strings.Join(groups, "；")
+}
+
+// formatServiceMode describes how a restaurant serves its orders, including the delivery fee.
+func formatServiceMode(restaurant *models.Restaurant) string {
+	switch {
+	case restaurant.ServiceMode == models.ServicePickup:
+		return "自取"
+	case restaurant.DeliveryFee > 0:
+		return fmt.Sprintf("外送，外送費 %d 元", restaurant.DeliveryFee)
+	case restaurant.ServiceMode == models.ServiceDelivery:
+		return "外送"
+	}
+	return ""
+}
+
+// parseServiceMode parses the Chinese name of a service mode.
+func parseServiceMode(s string) (models.ServiceMode, error) {
+	switch s {
+	case "外送":
+		return models.ServiceDelivery, nil
+	case "自取":
+		return models.ServicePickup, nil
+	case "":
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid service mode %q", s)
+}
+
+// restaurantInfoRows returns the labelled profile fields shown in the menu header.
+// Empty fields are left out.
+func restaurantInfoRows(restaurant *models.Restaurant) [][2]string {
+	var rows [][2]string
+	add := func(label, value string) {
+		if value != "" {
+			rows = append(rows, [2]string{label, value})
+		}
+	}
+	add("地址", restaurant.Address)
+	add("營業", formatOpeningHours(restaurant.OpeningHours))
+	if restaurant.MinimumOrder > 0 {
+		add("低消", fmt.Sprintf("%d 元", restaurant.MinimumOrder))
+	}
+	add("方式", formatServiceMode(restaurant))
+	add("備註", restaurant.Notes)
+	var tags []string
+	for _, tag := range restaurant.Tags {
+		tags = append(tags, tag.Name)
+	}
+	add("標籤", strings.Join(tags, "、"))
+	return rows
+}
+
+// openingHoursOn returns the opening periods of a restaurant on the weekday of t.
+func openingHoursOn(restaurant *models.Restaurant, t time.Time) []*models.OpeningHour {
+	var hours []*models.OpeningHour
+	for _, h := range restaurant.OpeningHours {
+		if h.Weekday == t.Weekday() {
+			hours = append(hours, h)
+		}
+	}
+	return hours
+}
+
+// isOpenAt reports whether a restaurant is open at t according to its weekly
+// opening hours. Restaurants without opening hours are assumed to be open.
+func isOpenAt(restaurant *models.Restaurant, t time.Time) bool {
+	if len(restaurant.OpeningHours) == 0 {
+		return true
+	}
+	clock := t.Format("15:04")
+	for _, h := range openingHoursOn(restaurant, t) {
+		if h.Opens <= clock && clock < h.Closes {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDeadline parses a time of day such as "11:30" as a deadline on the same day as now.
+func parseDeadline(s string, now time.Time) (time.Time, error) {
+	clock, err := normalizeClock(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", now.Format("2006-01-02 ")+clock, now.Location())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.Before(now) {
+		return time.Time{}, fmt.Errorf("deadline %s has passed", clock)
+	}
+	return t, nil
+}
+
+// parseDate parses a date given as "2006-01-02", or as "1-2" in the same year as now.
+func parseDate(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-1-2", s, now.Location()); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("1-2", s, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	return t.AddDate(now.Year(), 0, 0), nil
+}
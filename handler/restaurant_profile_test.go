@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOpeningHours(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "weekdays with two periods and saturday",
+			input:    "1-5 11:00-14:00 17:00-20:00;6 11:00-13:00",
+			expected: "一至五 11:00-14:00、17:00-20:00；六 11:00-13:00",
+		},
+		{
+			name:     "day list and sunday",
+			input:    "1、3、7 9:30-15:00",
+			expected: "一 09:30-15:00；三 09:30-15:00；日 09:30-15:00",
+		},
+		{
+			name:     "full-width separator",
+			input:    "1 11:00-14:00；2 11:00-14:00",
+			expected: "一至二 11:00-14:00",
+		},
+		{
+			name:     "empty clears hours",
+			input:    "",
+			expected: "",
+		},
+		{name: "missing periods", input: "1-5", expectErr: true},
+		{name: "invalid weekday", input: "0 11:00-14:00", expectErr: true},
+		{name: "invalid time", input: "1 11:00-25:00", expectErr: true},
+		{name: "period ends before it starts", input: "1 14:00-11:00", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hours, err := parseOpeningHours(tt.input)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, formatOpeningHours(hours))
+		})
+	}
+}
+
+func TestIsOpenAt(t *testing.T) {
+	hours, err := parseOpeningHours("1-5 11:00-14:00 17:00-20:00")
+	assert.NoError(t, err)
+	restaurant := &models.Restaurant{OpeningHours: hours}
+
+	// 2023-07-03 is a Monday
+	monday := func(clock string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", "2023-07-03 "+clock)
+		assert.NoError(t, err)
+		return tm
+	}
+
+	assert.True(t, isOpenAt(restaurant, monday("11:00")))
+	assert.True(t, isOpenAt(restaurant, monday("19:59")))
+	assert.False(t, isOpenAt(restaurant, monday("14:00")))
+	assert.False(t, isOpenAt(restaurant, monday("10:30")))
+	assert.False(t, isOpenAt(restaurant, monday("12:00").AddDate(0, 0, 5)), "closed on saturday")
+	assert.True(t, isOpenAt(&models.Restaurant{}, monday("03:00")), "no opening hours means unknown")
+}
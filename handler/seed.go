@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// seedFile is the layout of a seed file with a top-level "restaurants" list.
+type seedFile struct {
+	Restaurants []*MenuFile `yaml:"restaurants"`
+}
+
+// LoadSeedFile reads the restaurants of a seed file. Since JSON is valid YAML, both formats are accepted, either as
+// a list of restaurants or as an object with a "restaurants" list, using the same fields as menu exports.
+func LoadSeedFile(path string) ([]*MenuFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seed file: %w", err)
+	}
+	return decodeSeed(data)
+}
+
+// decodeSeed parses the content of a seed file and validates its restaurants.
+func decodeSeed(data []byte) ([]*MenuFile, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("invalid seed file: %w", err)
+	}
+	var files []*MenuFile
+	var err error
+	if len(node.Content) > 0 && node.Content[0].Kind == yaml.SequenceNode {
+		err = node.Decode(&files)
+	} else {
+		seed := &seedFile{}
+		err = node.Decode(seed)
+		files = seed.Restaurants
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed file: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for _, file := range files {
+		if file == nil {
+			return nil, fmt.Errorf("invalid seed file: empty restaurant")
+		}
+		if err := file.validate(); err != nil {
+			return nil, fmt.Errorf("invalid seed file: %w", err)
+		}
+		if names[file.Name] {
+			return nil, fmt.Errorf("invalid seed file: restaurant %s is listed twice", file.Name)
+		}
+		names[file.Name] = true
+	}
+	return files, nil
+}
+
+// Seed reconciles restaurants from a seed file into the database. Restaurants and menu items are matched by name
+// and updated in place, and aliases and tags are only added when missing, so seeding twice changes nothing.
+// Restaurants and items missing from the seed file are kept.
+func (a *AppHandler) Seed(files []*MenuFile) error {
+	for _, file := range files {
+		if _, err := a.importMenuFile(file); err != nil {
+			return fmt.Errorf("failed to seed restaurant %s: %w", file.Name, err)
+		}
+		a.Logger.Infof("已載入 %s 餐廳種子資料，共 %d 項餐點", file.Name, len(file.Items))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JohnsonYuanTW/NCAEats/models"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+)
+
+func TestLoadSeedFile(t *testing.T) {
+	t.Run("example file", func(t *testing.T) {
+		files, err := LoadSeedFile(filepath.Join("..", "seed", "seed.example.yaml"))
+		assert.NoError(t, err)
+		assert.Len(t, files, 2)
+		assert.Equal(t, "池上便當", files[0].Name)
+		assert.Equal(t, "1-5 11:00-14:00 17:00-20:00;6 11:00-13:00", files[0].OpeningHours)
+		assert.Equal(t, []string{"池上"}, files[0].Aliases)
+		assert.Equal(t, &MenuFileItem{Name: "雞腿飯", Price: 100}, files[0].Items[0])
+	})
+
+	tests := []struct {
+		name    string
+		content string
+		names   []string
+		err     bool
+	}{
+		{"yaml list", "- name: A\n  items: [{name: x, price: 1}]\n- name: B\n", []string{"A", "B"}, false},
+		{"json object", `{"restaurants": [{"name": "A", "minimumOrder": 100, "items": []}]}`, []string{"A"}, false},
+		{"json list", `[{"name": "A"}]`, []string{"A"}, false},
+		{"duplicate restaurant", "- name: A\n- name: A\n", nil, true},
+		{"invalid opening hours", "- name: A\n  openingHours: everyday\n", nil, true},
+		{"missing name", "restaurants:\n  - tel: '123'\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "seed.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0o644))
+
+			files, err := LoadSeedFile(path)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			var names []string
+			for _, file := range files {
+				names = append(names, file.Name)
+			}
+			assert.Equal(t, tt.names, names)
+		})
+	}
+}
+
+func TestSeed(t *testing.T) {
+	mockRestaurantRepo := &MockRestaurantRepository{}
+	mockMenuItemRepo := &MockMenuItemRepository{}
+	appHandler := &AppHandler{
+		Logger:         logrus.New(),
+		RestaurantRepo: mockRestaurantRepo,
+		MenuItemRepo:   mockMenuItemRepo,
+	}
+
+	mockRestaurantRepo.On("UpsertRestaurant", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(*models.Restaurant).ID = 1
+	}).Return(nil, nil)
+	mockRestaurantRepo.On("AddRestaurantTags", uint(1), []string{"便當"}).Return(nil)
+	mockRestaurantRepo.On("GetRestaurantByID", uint(1)).Return(&models.Restaurant{
+		Model:   gorm.Model{ID: 1},
+		Aliases: []*models.RestaurantAlias{{Name: "池上"}},
+	}, nil)
+	mockRestaurantRepo.On("AddRestaurantAlias", &models.RestaurantAlias{RestaurantID: 1, Name: "池上飯包"}).Return(nil).Once()
+	mockMenuItemRepo.On("UpsertMenuItem", mock.Anything).Return(nil, nil)
+
+	err := appHandler.Seed([]*MenuFile{{
+		Name:    "池上便當",
+		Aliases: []string{"池上", "池上飯包"},
+		Tags:    []string{"便當"},
+		Items:   []*MenuFileItem{{Name: "雞腿飯", Price: 100}},
+	}})
+	assert.NoError(t, err)
+
+	// Existing aliases are not added again
+	mockRestaurantRepo.AssertNotCalled(t, "AddRestaurantAlias", &models.RestaurantAlias{RestaurantID: 1, Name: "池上"})
+	mockRestaurantRepo.AssertExpectations(t)
+	mockMenuItemRepo.AssertExpectations(t)
+}
@@ -1,7 +1,10 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
 	"os"
 
 	"path/filepath"
@@ -12,12 +15,14 @@ import (
 
 type TemplateHandler struct {
 	templates map[string]string
+	html      *template.Template
 }
 
 type TemplateHandlerInterface interface {
 	GetTemplate(string) (string, error)
 	generateFlexContainer(string, ...interface{}) (linebot.FlexContainer, error)
 	generateBoxComponent(string, ...interface{}) (linebot.BoxComponent, error)
+	renderHTML(io.Writer, string, interface{}) error
 }
 
 func NewTemplateHandler(dir string) (*TemplateHandler, error) {
@@ -46,7 +51,33 @@ func NewTemplateHandler(dir string) (*TemplateHandler, error) {
 		templates[baseName] = string(content)
 	}
 
-	return &TemplateHandler{templates: templates}, nil
+	// HTML pages live in the html subdirectory and are rendered with html/template
+	html := template.New("").Funcs(template.FuncMap{"price": formatPrice})
+	htmlDir := filepath.Join(dir, "html")
+	if _, err := os.Stat(htmlDir); err == nil {
+		if html, err = html.ParseGlob(filepath.Join(htmlDir, "*.html")); err != nil {
+			return nil, fmt.Errorf("failed to parse HTML templates: %w", err)
+		}
+	}
+
+	return &TemplateHandler{templates: templates, html: html}, nil
+}
+
+// renderHTML renders the HTML template of the given file name, escaping data for HTML.
+func (t *TemplateHandler) renderHTML(w io.Writer, name string, data interface{}) error {
+	return t.html.ExecuteTemplate(w, name, data)
+}
+
+// formatPrice formats an amount of NTD with thousands separators, e.g. 1,250.
+func formatPrice(amount int) string {
+	s := fmt.Sprint(amount)
+	if amount < 0 {
+		return "-" + formatPrice(-amount)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
 }
 
 func (t *TemplateHandler) GetTemplate(name string) (string, error) {
@@ -67,9 +98,17 @@ func (t *TemplateHandler) getComponent(name string, unmarshal unmarshalFunc, dat
 		return nil, err
 	}
 
-	// Insert data (if any) into the template
+	// Insert data (if any) into the template, escaping strings so that user
+	// input cannot break out of the JSON string literals
 	if len(data) != 0 {
-		template = fmt.Sprintf(template, data...)
+		escaped := make([]interface{}, len(data))
+		for i, d := range data {
+			if str, ok := d.(string); ok {
+				d = escapeJSONString(str)
+			}
+			escaped[i] = d
+		}
+		template = fmt.Sprintf(template, escaped...)
 	}
 
 	// Parse JSON to linebot flex container
@@ -81,6 +120,12 @@ func (t *TemplateHandler) getComponent(name string, unmarshal unmarshalFunc, dat
 	return component, nil
 }
 
+// escapeJSONString escapes s for use inside a JSON string literal.
+func escapeJSONString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
 func unmarshalFlexContainer(data []byte) (interface{}, error) {
 	flexContainer, err := linebot.UnmarshalFlexMessageJSON(data)
 	return flexContainer, err
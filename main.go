@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
-	"net/http"
 	"net/url"
+	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -79,6 +79,22 @@ func main() {
 	}
 	log.Info("資料庫連線成功")
 
+	// The seed subcommand only loads a seed file, without the LINE bot and web server
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		if len(os.Args) != 3 {
+			log.Fatal("用法: main seed <種子檔案>")
+		}
+		appHandler, err := handler.NewAppHandler(log, templates, s, nil, db)
+		if err != nil {
+			log.WithError(err).Fatal("模型初始化失敗")
+		}
+		if err := seedDatabase(appHandler, os.Args[2]); err != nil {
+			log.WithError(err).Fatal("種子資料載入失敗")
+		}
+		log.Info("種子資料載入成功")
+		return
+	}
+
 	// Create LineBot client
 	bot, err := linebot.New(s.ChannelSecret, s.ChannelAccessToken)
 	if err != nil {
@@ -93,6 +109,14 @@ func main() {
 	}
 	log.Info("模型初始化成功")
 
+	// Load seed file
+	if s.SeedFile != "" {
+		if err := seedDatabase(appHandler, s.SeedFile); err != nil {
+			log.WithError(err).Fatal("種子資料載入失敗")
+		}
+		log.Info("種子資料載入成功")
+	}
+
 	log.Info("程式已啟動...")
 
 	// Set up routes
@@ -100,26 +124,18 @@ func main() {
 	r := gin.New()
 	r.Use(gin.Recovery(), customLogger(log))
 	r.POST("/callback", appHandler.CallbackHandler)
-	r.GET("/userReport/:reportID", func(c *gin.Context) {
-		reportID := c.Params.ByName("reportID")
-
-		// Look up the orderID of ReportID in the db
-		orderID, err := appHandler.OrderRepo.GetOrderIDByReportID(reportID)
-		if err != nil {
-			c.String(http.StatusNotFound, "Report not found")
-			log.WithError(err).Errorf("無法取得 %s 報表對應的訂單", reportID)
-			return
-		}
-
-		// Get reportHTML
-		reportHTML, err := appHandler.OrderRepo.GetOrderReportByOrderID(orderID)
-		if err != nil {
-			c.String(http.StatusNotFound, "Report not found")
-			log.WithError(err).Errorf("無法取得 %s 報表", reportID)
-			return
-		}
-		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(reportHTML))
-	})
+	api := r.Group("/api", appHandler.APIAuthMiddleware())
+	api.GET("/restaurants/:id/menu.csv", appHandler.ExportMenuCSVHandler)
+	api.GET("/restaurants/:id/menu.json", appHandler.ExportMenuJSONHandler)
+	api.POST("/restaurants", appHandler.ImportMenuHandler)
+	api.GET("/chats/:chatID/reports.csv", appHandler.ExportChatReportsCSVHandler)
+	api.GET("/chats/:chatID/reports.xlsx", appHandler.ExportChatReportsXLSXHandler)
+	if s.UploadDir != "" {
+		r.Static("/uploads", s.UploadDir)
+	}
+	r.GET("/userReport/:reportID", appHandler.UserReportHandler)
+	r.GET("/live/:reportID", appHandler.LiveOrderHandler)
+	r.GET("/live/:reportID/events", appHandler.LiveOrderEventsHandler)
 
 	// Start server
 	addr := fmt.Sprintf(":%s", s.Port)
@@ -133,6 +149,14 @@ func main() {
 	}
 }
 
+func seedDatabase(appHandler *handler.AppHandler, path string) error {
+	files, err := handler.LoadSeedFile(path)
+	if err != nil {
+		return err
+	}
+	return appHandler.Seed(files)
+}
+
 func customLogger(log *logrus.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Start timer
@@ -3,26 +3,51 @@ package models
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
 // MenuItem represents a single item on a restaurant's menu.
+// Code is a number that identifies the item within its restaurant for fast ordering. Items not numbered yet have
+// code 0.
 type MenuItem struct {
 	gorm.Model
-	Name         string
+	Code         int    `gorm:"uniqueIndex:idx_menu_items_restaurant_code,priority:2,where:deleted_at IS NULL AND code > 0"`
+	Name         string `gorm:"uniqueIndex:idx_menu_items_restaurant_name,priority:2,where:deleted_at IS NULL"`
 	Price        int
-	RestaurantID uint
+	ImageURL     string
+	RestaurantID uint `gorm:"uniqueIndex:idx_menu_items_restaurant_name,priority:1,where:deleted_at IS NULL;uniqueIndex:idx_menu_items_restaurant_code,priority:1,where:deleted_at IS NULL AND code > 0"`
 	Restaurant   *Restaurant
+	ComboSlots   []*ComboSlot
+}
+
+// IsCombo reports whether the item is a set meal whose components are chosen when ordering.
+func (mi *MenuItem) IsCombo() bool {
+	return len(mi.ComboSlots) > 0
+}
+
+// ComboSlot is a required choice of a combo, such as its soup or drink, picked from other items of the restaurant.
+type ComboSlot struct {
+	gorm.Model
+	MenuItemID uint `gorm:"index"`
+	Position   int
+	Name       string
+	Options    []*MenuItem `gorm:"many2many:combo_slot_options"`
 }
 
 // MenuItemRepository defines the database operations for menu items.
 type MenuItemRepository interface {
 	Init() error
 	CreateMenuItem(*MenuItem) error
+	UpsertMenuItem(*MenuItem) (*MenuItem, error)
 	GetMenuItemsByRestaurantName(string) ([]*MenuItem, error)
 	GetMenuItemByDetails(string, string) (*MenuItem, error)
+	GetMenuItemByCode(int, string) (*MenuItem, error)
+	SetMenuItemImageURL(uint, string) error
+	SetComboSlots(uint, []*ComboSlot) error
+	SearchMenuItems(string, int) ([]*MenuItem, error)
 }
 
 // MenuItemGormRepository implements the MenuItemRepository using the Gorm library.
@@ -32,25 +57,193 @@ type MenuItemGormRepository struct {
 
 // Init initializes the menu item repository and performs auto-migrations.
 func (r *MenuItemGormRepository) Init() error {
-	if err := r.DB.AutoMigrate(&MenuItem{}); err != nil {
+	// Delete all but the oldest of duplicate items before adding the unique index
+	if r.DB.Migrator().HasTable(&MenuItem{}) {
+		if err := r.DB.Exec(`
+			UPDATE menu_items
+			SET deleted_at = NOW()
+			WHERE deleted_at IS NULL
+				AND id NOT IN (
+					SELECT MIN(id) FROM menu_items
+					WHERE deleted_at IS NULL
+					GROUP BY restaurant_id, name
+				)`).Error; err != nil {
+			return fmt.Errorf("failed to delete duplicate MenuItems: %w", err)
+		}
+	}
+
+	// Renumber all but the oldest of items sharing a code, which concurrent creation could assign, after the
+	// highest code of their restaurant before adding the unique index
+	if r.DB.Migrator().HasColumn(&MenuItem{}, "code") {
+		if err := r.DB.Exec(`
+			UPDATE menu_items
+			SET code = renumbered.code
+			FROM (
+				SELECT duplicates.id,
+					(SELECT MAX(code) FROM menu_items AS m WHERE m.restaurant_id = duplicates.restaurant_id)
+						+ ROW_NUMBER() OVER (PARTITION BY duplicates.restaurant_id ORDER BY duplicates.id) AS code
+				FROM menu_items AS duplicates
+				WHERE duplicates.deleted_at IS NULL
+					AND duplicates.code > 0
+					AND duplicates.id NOT IN (
+						SELECT MIN(id) FROM menu_items
+						WHERE deleted_at IS NULL AND code > 0
+						GROUP BY restaurant_id, code
+					)
+			) AS renumbered
+			WHERE menu_items.id = renumbered.id`).Error; err != nil {
+			return fmt.Errorf("failed to renumber duplicate MenuItem codes: %w", err)
+		}
+	}
+
+	if err := r.DB.AutoMigrate(&MenuItem{}, &ComboSlot{}); err != nil {
 		return fmt.Errorf("failed to auto migrate MenuItem: %w", err)
 	}
+
+	// Number the items of restaurants created before codes were assigned
+	if err := r.DB.Exec(`
+		UPDATE menu_items
+		SET code = numbered.code
+		FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY restaurant_id ORDER BY id) AS code
+			FROM menu_items
+		) AS numbered
+		WHERE menu_items.id = numbered.id
+			AND menu_items.restaurant_id IN (
+				SELECT restaurant_id FROM menu_items
+				GROUP BY restaurant_id
+				HAVING MAX(COALESCE(code, 0)) = 0
+			)`).Error; err != nil {
+		return fmt.Errorf("failed to backfill MenuItem codes: %w", err)
+	}
+
+	// Item names used to have a trigram index, which cannot serve searches for the one or two characters of most
+	// item names and needs the pg_trgm extension. Menus are small enough to be searched without an index.
+	if err := r.DB.Exec("DROP INDEX IF EXISTS idx_menu_items_name_trgm").Error; err != nil {
+		return fmt.Errorf("failed to drop MenuItem name search index: %w", err)
+	}
 	return nil
 }
 
-// CreateMenuItem inserts a new menu item into the database.
+// CreateMenuItem inserts a new menu item into the database, numbering it after the existing
+// items of its restaurant unless it has a code no other item has. Codes of deleted items are not reused.
 func (r *MenuItemGormRepository) CreateMenuItem(mi *MenuItem) error {
-	if err := r.DB.Create(mi).Error; err != nil {
+	if err := r.DB.Transaction(func(tx *gorm.DB) error {
+		return createMenuItem(tx, mi)
+	}); err != nil {
 		return fmt.Errorf("failed to create menu item: %w", err)
 	}
 	return nil
 }
 
-// GetMenuItemsByRestaurantName fetches all menu items for a given restaurant name.
+// UpsertMenuItem creates a menu item, or updates the non-zero fields of the item with the same name in the same
+// restaurant. Codes are only changed to ones no other item has. It returns the item as it was before the update,
+// or nil if it was created.
+func (r *MenuItemGormRepository) UpsertMenuItem(mi *MenuItem) (*MenuItem, error) {
+	var previous *MenuItem
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var existing MenuItem
+		err := tx.Where("restaurant_id = ? AND name = ?", restaurantIDOf(mi), mi.Name).Take(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return createMenuItem(tx, mi)
+		} else if err != nil {
+			return err
+		}
+
+		previous = &existing
+		if mi.Code != 0 && mi.Code != existing.Code {
+			if err := lockRestaurant(tx, restaurantIDOf(mi)); err != nil {
+				return err
+			}
+			taken, err := codeTaken(tx, restaurantIDOf(mi), mi.Code)
+			if err != nil {
+				return err
+			}
+			if taken {
+				mi.Code = 0
+			}
+		}
+		if err := tx.Model(&MenuItem{}).Where("id = ?", existing.ID).Omit(clause.Associations).Updates(mi).Error; err != nil {
+			return err
+		}
+		return tx.Omit(clause.Associations).Take(mi, existing.ID).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert menu item %s: %w", mi.Name, err)
+	}
+	return previous, nil
+}
+
+// createMenuItem inserts a menu item within tx, keeping its code if no other item of its restaurant has it, or else
+// numbering it after the existing items of its restaurant. The restaurant is locked until tx ends, so that items
+// created concurrently are numbered one after the other.
+func createMenuItem(tx *gorm.DB, mi *MenuItem) error {
+	if err := lockRestaurant(tx, restaurantIDOf(mi)); err != nil {
+		return err
+	}
+	if mi.Code > 0 {
+		taken, err := codeTaken(tx, restaurantIDOf(mi), mi.Code)
+		if err != nil {
+			return err
+		}
+		if !taken {
+			return tx.Create(mi).Error
+		}
+	}
+	if err := tx.Unscoped().Model(&MenuItem{}).
+		Select("COALESCE(MAX(code), 0) + 1").
+		Where("restaurant_id = ?", restaurantIDOf(mi)).
+		Scan(&mi.Code).Error; err != nil {
+		return err
+	}
+	return tx.Create(mi).Error
+}
+
+// lockRestaurant locks a restaurant until tx ends, so that the codes of its items are assigned one at a time.
+func lockRestaurant(tx *gorm.DB, restaurantID uint) error {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		Take(&Restaurant{}, restaurantID).Error; err != nil {
+		return fmt.Errorf("failed to lock restaurant %d: %w", restaurantID, err)
+	}
+	return nil
+}
+
+// codeTaken reports whether an item of a restaurant, deleted or not, has a code.
+func codeTaken(tx *gorm.DB, restaurantID uint, code int) (bool, error) {
+	var count int64
+	if err := tx.Unscoped().Model(&MenuItem{}).
+		Where("restaurant_id = ? AND code = ?", restaurantID, code).
+		Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to check code %d of restaurant %d: %w", code, restaurantID, err)
+	}
+	return count > 0, nil
+}
+
+// restaurantIDOf returns the ID of the restaurant a menu item belongs to.
+func restaurantIDOf(mi *MenuItem) uint {
+	if mi.Restaurant != nil {
+		return mi.Restaurant.ID
+	}
+	return mi.RestaurantID
+}
+
+// orderByPosition and orderByCode order preloaded combo slots and their options.
+func orderByPosition(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+func orderByCode(db *gorm.DB) *gorm.DB {
+	return db.Order("code")
+}
+
+// GetMenuItemsByRestaurantName fetches all menu items for a given restaurant name, ordered by their codes.
 func (r *MenuItemGormRepository) GetMenuItemsByRestaurantName(name string) ([]*MenuItem, error) {
 	var restaurant Restaurant
 	if err := r.DB.
-		Preload(clause.Associations).
+		Preload("MenuItems", orderByCode).
+		Preload("MenuItems.ComboSlots", orderByPosition).
+		Preload("MenuItems.ComboSlots.Options", orderByCode).
 		Where("name = ?", name).
 		Take(&restaurant).Error; err != nil {
 		return nil, fmt.Errorf("failed to fetch restaurant by name %s: %w", name, err)
@@ -62,17 +255,91 @@ func (r *MenuItemGormRepository) GetMenuItemsByRestaurantName(name string) ([]*M
 func (r *MenuItemGormRepository) GetMenuItemByDetails(itemName, restaurantName string) (*MenuItem, error) {
 	var menuItem MenuItem
 	err := r.DB.
-		Preload("Restaurant", "name = ?", restaurantName).
-		Where("name = ?", itemName).
+		Joins("Restaurant").
+		Preload("ComboSlots", orderByPosition).
+		Preload("ComboSlots.Options", orderByCode).
+		Where("menu_items.name = ? AND \"Restaurant\".name = ?", itemName, restaurantName).
 		Take(&menuItem).Error
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch menu item by details: %w", err)
 	}
 
-	if menuItem.Restaurant == nil || menuItem.Restaurant.Name != restaurantName {
-		return nil, errors.New("no matching menu item found")
+	return &menuItem, nil
+}
+
+// GetMenuItemByCode fetches a menu item based on its code and the name of its restaurant.
+func (r *MenuItemGormRepository) GetMenuItemByCode(code int, restaurantName string) (*MenuItem, error) {
+	var menuItem MenuItem
+	err := r.DB.
+		Joins("Restaurant").
+		Preload("ComboSlots", orderByPosition).
+		Preload("ComboSlots.Options", orderByCode).
+		Where("menu_items.code = ? AND \"Restaurant\".name = ?", code, restaurantName).
+		Take(&menuItem).Error
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch menu item by code %d: %w", code, err)
 	}
 
 	return &menuItem, nil
 }
+
+// SetMenuItemImageURL sets the thumbnail shown next to a menu item.
+func (r *MenuItemGormRepository) SetMenuItemImageURL(menuItemID uint, imageURL string) error {
+	if err := r.DB.Model(&MenuItem{}).Where("id=?", menuItemID).Update("image_url", imageURL).Error; err != nil {
+		return fmt.Errorf("failed to set image of menu item %d: %w", menuItemID, err)
+	}
+	return nil
+}
+
+// SetComboSlots replaces the choice slots of a combo. Slots are numbered in the given order, and their options must
+// be existing menu items.
+func (r *MenuItemGormRepository) SetComboSlots(menuItemID uint, slots []*ComboSlot) error {
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var previous []*ComboSlot
+		if err := tx.Where("menu_item_id=?", menuItemID).Find(&previous).Error; err != nil {
+			return err
+		}
+		for _, slot := range previous {
+			if err := tx.Model(slot).Association("Options").Clear(); err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("menu_item_id=?", menuItemID).Delete(&ComboSlot{}).Error; err != nil {
+			return err
+		}
+
+		for i, slot := range slots {
+			slot.MenuItemID = menuItemID
+			slot.Position = i + 1
+		}
+		if len(slots) == 0 {
+			return nil
+		}
+		return tx.Omit("Options.*").Create(slots).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set combo slots of menu item %d: %w", menuItemID, err)
+	}
+	return nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SearchMenuItems fetches up to limit menu items of all restaurants whose names contain query, ignoring case,
+// ordered by restaurant and code.
+func (r *MenuItemGormRepository) SearchMenuItems(query string, limit int) ([]*MenuItem, error) {
+	var menuItems []*MenuItem
+	err := r.DB.
+		Joins("Restaurant").
+		Where("\"Restaurant\".id IS NOT NULL AND menu_items.name ILIKE ?", "%"+likeEscaper.Replace(query)+"%").
+		Order("\"Restaurant\".name, menu_items.code").
+		Limit(limit).
+		Find(&menuItems).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to search menu items by %s: %w", query, err)
+	}
+	return menuItems, nil
+}
@@ -7,13 +7,36 @@ import (
 )
 
 // OrderDetail represents the details of a single order, including the menu items.
+// ItemName and UnitPrice are copied from the menu item when it is ordered, so
+// later menu edits do not change historical totals. Items typed in by hand with
+// their price, such as those read off a menu photo, have no MenuItemID. Choices
+// lists the components picked for a combo, and Note is a free-text request such
+// as "不要辣".
 type OrderDetail struct {
 	gorm.Model
 	Owner      string
 	OrderID    uint
 	Order      *Order
-	MenuItemID uint
+	MenuItemID *uint
 	MenuItem   *MenuItem
+	ItemName   string
+	Choices    string
+	Note       string
+	UnitPrice  int
+	Quantity   int `gorm:"default:1"`
+}
+
+// Subtotal returns the price of this order detail.
+func (od *OrderDetail) Subtotal() int {
+	return od.UnitPrice * od.Quantity
+}
+
+// DisplayName returns the item name followed by the chosen components of a combo, e.g. "雞腿套餐 (玉米濃湯、紅茶)".
+func (od *OrderDetail) DisplayName() string {
+	if od.Choices == "" {
+		return od.ItemName
+	}
+	return fmt.Sprintf("%s (%s)", od.ItemName, od.Choices)
 }
 
 // OrderDetailRepository defines the database operations for order details.
@@ -21,6 +44,9 @@ type OrderDetailRepository interface {
 	Init() error
 	CreateOrderDetail(*OrderDetail) error
 	GetActiveOrderDetailsByOrderID(uint) ([]*OrderDetail, error)
+	GetAllOrderDetailsByOrderID(uint) ([]*OrderDetail, error)
+	GetPopularMenuItemIDs(uint, string, int) ([]uint, error)
+	GetMenuItemIDsOrderedByOwner(uint, string) ([]uint, error)
 	DeleteOrderDetailsByOrderID(uint) error
 }
 
@@ -34,6 +60,16 @@ func (r *OrderDetailGormRepository) Init() error {
 	if err := r.DB.AutoMigrate(&OrderDetail{}); err != nil {
 		return fmt.Errorf("failed to auto migrate OrderDetail: %w", err)
 	}
+
+	// Backfill snapshots for order details created before they were recorded
+	if err := r.DB.Exec(`
+		UPDATE order_details
+		SET item_name = menu_items.name, unit_price = menu_items.price
+		FROM menu_items
+		WHERE order_details.menu_item_id = menu_items.id
+			AND (order_details.item_name IS NULL OR order_details.item_name = '')`).Error; err != nil {
+		return fmt.Errorf("failed to backfill OrderDetail snapshots: %w", err)
+	}
 	return nil
 }
 
@@ -45,11 +81,12 @@ func (r *OrderDetailGormRepository) CreateOrderDetail(od *OrderDetail) error {
 	return nil
 }
 
-// GetActiveOrderDetailsByOrderID fetches all active order details for a given order ID.
+// GetActiveOrderDetailsByOrderID fetches all active order details for a given order ID, in the order they were created.
 func (r *OrderDetailGormRepository) GetActiveOrderDetailsByOrderID(orderID uint) ([]*OrderDetail, error) {
 	var orderDetails []*OrderDetail
 	result := r.DB.
 		Where("order_id=?", orderID).
+		Order("id").
 		Preload("MenuItem").
 		Find(&orderDetails)
 	if result.Error != nil {
@@ -58,6 +95,48 @@ func (r *OrderDetailGormRepository) GetActiveOrderDetailsByOrderID(orderID uint)
 	return orderDetails, nil
 }
 
+// GetAllOrderDetailsByOrderID fetches all order details for a given order ID, including those of cleared orders.
+func (r *OrderDetailGormRepository) GetAllOrderDetailsByOrderID(orderID uint) ([]*OrderDetail, error) {
+	var orderDetails []*OrderDetail
+	result := r.DB.Unscoped().Where("order_id=?", orderID).Find(&orderDetails)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch all order details by order ID %d: %w", orderID, result.Error)
+	}
+	return orderDetails, nil
+}
+
+// GetPopularMenuItemIDs fetches the IDs of the most-ordered menu items of a restaurant in a chat, including cleared
+// orders, ordered by the quantity ordered.
+func (r *OrderDetailGormRepository) GetPopularMenuItemIDs(restaurantID uint, chatID string, limit int) ([]uint, error) {
+	var menuItemIDs []uint
+	result := r.DB.Unscoped().Model(&OrderDetail{}).
+		Joins("JOIN orders ON orders.id = order_details.order_id").
+		Where("orders.restaurant_id = ? AND orders.chat_id = ? AND order_details.menu_item_id IS NOT NULL", restaurantID, chatID).
+		Group("order_details.menu_item_id").
+		Order("SUM(order_details.quantity) DESC, order_details.menu_item_id").
+		Limit(limit).
+		Pluck("order_details.menu_item_id", &menuItemIDs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch popular menu items of restaurant %d: %w", restaurantID, result.Error)
+	}
+	return menuItemIDs, nil
+}
+
+// GetMenuItemIDsOrderedByOwner fetches the IDs of all menu items of a restaurant an owner has ordered before,
+// including cleared orders.
+func (r *OrderDetailGormRepository) GetMenuItemIDsOrderedByOwner(restaurantID uint, owner string) ([]uint, error) {
+	var menuItemIDs []uint
+	result := r.DB.Unscoped().Model(&OrderDetail{}).
+		Joins("JOIN orders ON orders.id = order_details.order_id").
+		Where("orders.restaurant_id = ? AND order_details.owner = ? AND order_details.menu_item_id IS NOT NULL", restaurantID, owner).
+		Distinct().
+		Pluck("order_details.menu_item_id", &menuItemIDs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch menu items of restaurant %d ordered by %s: %w", restaurantID, owner, result.Error)
+	}
+	return menuItemIDs, nil
+}
+
 // DeleteOrderDetailsByOrderID removes all order details associated with a given order ID.
 func (r *OrderDetailGormRepository) DeleteOrderDetailsByOrderID(orderID uint) error {
 	var orderDetails []OrderDetail
@@ -1,8 +1,10 @@
 package models
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
-	"math/rand"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -10,12 +12,37 @@ import (
 // Order represents a restaurant order with associated details.
 type Order struct {
 	gorm.Model
-	Owner        string
-	ReportHTML   string
-	ReportID     string
-	RestaurantID uint
-	Restaurant   *Restaurant
-	OrderDetails []*OrderDetail
+	Owner    string
+	ChatID   string `gorm:"index"`
+	Deadline *time.Time
+	Report   *OrderReport `gorm:"type:jsonb;serializer:json"`
+	// ReportID is the secret in the links to the live page and the report of the order. Links stop working once
+	// ReportExpiresAt has passed, if it is set.
+	ReportID        string `gorm:"uniqueIndex:idx_orders_report_id,where:report_id <> ''"`
+	ReportExpiresAt *time.Time
+	RestaurantID    uint
+	Restaurant      *Restaurant
+	OrderDetails    []*OrderDetail
+}
+
+// OrderReport is a snapshot of an order taken when its report is generated, rendered as the user report page.
+type OrderReport struct {
+	Restaurant  string        `json:"restaurant"`
+	Tel         string        `json:"tel,omitempty"`
+	GeneratedAt time.Time     `json:"generatedAt"`
+	Lines       []*ReportLine `json:"lines"`
+}
+
+// ReportLine is an item ordered by a participant in an OrderReport. Code is the menu code of the item, or 0 for
+// items typed in by hand.
+type ReportLine struct {
+	Participant string `json:"participant"`
+	Code        int    `json:"code,omitempty"`
+	Item        string `json:"item"`
+	Note        string `json:"note,omitempty"`
+	Quantity    int    `json:"quantity"`
+	UnitPrice   int    `json:"unitPrice"`
+	Subtotal    int    `json:"subtotal"`
 }
 
 // OrderRepository provides an interface for database operations on orders.
@@ -24,30 +51,81 @@ type OrderRepository interface {
 	CreateOrder(*Order) error
 	GetActiveOrders() ([]*Order, error)
 	GetActiveOrdersOfOwnerID(string) ([]*Order, error)
+	GetOrderByID(uint) (*Order, error)
 	CountActiveOrdersOfOwnerID(string) (int64, error)
-	SaveOrderReport(uint, string) error
-	GenerateUniqueReportID() string
-	GetOrderReportByOrderID(uint) (string, error)
+	GetRestaurantIDsOrderedSince(time.Time) ([]uint, error)
+	GetClosedOrdersOfChatID(string, time.Time, time.Time) ([]*Order, error)
+	SaveOrderReport(uint, *OrderReport) error
+	RevokeReportID(uint) error
+	GetOrderReportByOrderID(uint) (*OrderReport, error)
 	GetOrderReportIDByOrderID(uint) (string, error)
 	GetOrderIDByReportID(string) (uint, error)
+	GetOrderIDsWithLegacyReport() ([]uint, error)
+	SaveLegacyReport(uint, *OrderReport) error
+	DropLegacyReports() error
 	DeleteOrderByOrderID(uint) error
 }
 
-// OrderGormRepository implements the OrderRepository using the Gorm library.
+// OrderGormRepository implements the OrderRepository using the Gorm library. Report links are valid for
+// ReportLinkTTL after they are issued, or forever if it is zero.
 type OrderGormRepository struct {
 	*BaseRepository
+	ReportLinkTTL time.Duration
 }
 
+// reportIDBytes is the number of random bytes in a report ID, which is 22 characters long.
+const reportIDBytes = 16
+
 // Init initializes the order repository and performs automigrations.
 func (r *OrderGormRepository) Init() error {
+	// Report IDs used to be 6 characters from math/rand, short enough to guess, and may collide with each other
+	if r.DB.Migrator().HasTable(&Order{}) {
+		if err := r.reissueShortReportIDs(); err != nil {
+			return err
+		}
+	}
+
 	if err := r.DB.AutoMigrate(&Order{}); err != nil {
 		return fmt.Errorf("failed to auto migrate Order: %w", err)
 	}
+
+	// Orders created before chats were recorded are attributed to the chat with their owner
+	if err := r.DB.Unscoped().Model(&Order{}).
+		Where("chat_id IS NULL OR chat_id = ''").
+		Update("chat_id", gorm.Expr("owner")).Error; err != nil {
+		return fmt.Errorf("failed to backfill Order chats: %w", err)
+	}
+	return nil
+}
+
+// reissueShortReportIDs replaces the report IDs shorter than the current ones, which breaks links to them.
+func (r *OrderGormRepository) reissueShortReportIDs() error {
+	var orderIDs []uint
+	if err := r.DB.Unscoped().Model(&Order{}).
+		Where("report_id <> '' AND length(report_id) < ?", base64.RawURLEncoding.EncodedLen(reportIDBytes)).
+		Pluck("id", &orderIDs).Error; err != nil {
+		return fmt.Errorf("failed to fetch Order short report IDs: %w", err)
+	}
+	for _, orderID := range orderIDs {
+		reportID, err := newReportID()
+		if err != nil {
+			return err
+		}
+		if err := r.DB.Unscoped().Model(&Order{}).Where("id = ?", orderID).Update("report_id", reportID).Error; err != nil {
+			return fmt.Errorf("failed to reissue report ID of order %d: %w", orderID, err)
+		}
+	}
 	return nil
 }
 
-// CreateOrder inserts a new order into the database.
+// CreateOrder inserts a new order into the database. The order gets its report ID up front, so that its live page
+// and its report share one link.
 func (r *OrderGormRepository) CreateOrder(o *Order) error {
+	if o.ReportID == "" {
+		if err := r.issueReportID(o); err != nil {
+			return err
+		}
+	}
 	if err := r.DB.Create(o).Error; err != nil {
 		return fmt.Errorf("failed to create order: %w", err)
 	}
@@ -64,16 +142,25 @@ func (r *OrderGormRepository) GetActiveOrders() ([]*Order, error) {
 	return orders, nil
 }
 
-// GetActiveOrdersOfOwnerID fetches all active orders for a given owner ID.
+// GetActiveOrdersOfOwnerID fetches all active orders for a given owner ID, with their restaurants and menu photos.
 func (r *OrderGormRepository) GetActiveOrdersOfOwnerID(ownerID string) ([]*Order, error) {
 	var orders []*Order
-	result := r.DB.Preload("Restaurant").Where("owner=?", ownerID).Find(&orders)
+	result := r.DB.Preload("Restaurant.MenuPhotos").Where("owner=?", ownerID).Find(&orders)
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to fetch orders for owner %s: %w", ownerID, result.Error)
 	}
 	return orders, nil
 }
 
+// GetOrderByID fetches an order and its restaurant by its ID, including cleared orders.
+func (r *OrderGormRepository) GetOrderByID(orderID uint) (*Order, error) {
+	order := &Order{}
+	if err := r.DB.Unscoped().Preload("Restaurant").First(order, orderID).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch order with ID %d: %w", orderID, err)
+	}
+	return order, nil
+}
+
 // CountActiveOrdersOfOwnerID counts all active orders for a given owner ID.
 func (r *OrderGormRepository) CountActiveOrdersOfOwnerID(ownerID string) (int64, error) {
 	var count int64
@@ -84,17 +171,44 @@ func (r *OrderGormRepository) CountActiveOrdersOfOwnerID(ownerID string) (int64,
 	return count, nil
 }
 
-// SaveOrderReport updates an order with its report.
-func (r *OrderGormRepository) SaveOrderReport(orderID uint, report string) error {
+// GetRestaurantIDsOrderedSince fetches the IDs of restaurants of all orders created since t, including cleared ones.
+func (r *OrderGormRepository) GetRestaurantIDsOrderedSince(t time.Time) ([]uint, error) {
+	var restaurantIDs []uint
+	result := r.DB.Unscoped().Model(&Order{}).Distinct().Where("created_at >= ?", t).Pluck("restaurant_id", &restaurantIDs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch restaurants ordered since %s: %w", t, result.Error)
+	}
+	return restaurantIDs, nil
+}
+
+// GetClosedOrdersOfChatID fetches the cleared orders of a chat created in [from, to), oldest first, with their
+// restaurants even if those were removed since.
+func (r *OrderGormRepository) GetClosedOrdersOfChatID(chatID string, from, to time.Time) ([]*Order, error) {
+	var orders []*Order
+	result := r.DB.Unscoped().
+		Preload("Restaurant", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+		Where("chat_id = ? AND deleted_at IS NOT NULL AND created_at >= ? AND created_at < ?", chatID, from, to).
+		Order("created_at, id").
+		Find(&orders)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch closed orders of chat %s: %w", chatID, result.Error)
+	}
+	return orders, nil
+}
+
+// SaveOrderReport updates an order with its report, giving it a new report ID if it has none or it has expired.
+func (r *OrderGormRepository) SaveOrderReport(orderID uint, report *OrderReport) error {
 	order := &Order{}
 	if err := r.DB.First(order, orderID).Error; err != nil {
 		return err
 	}
 
-	reportID := r.GenerateUniqueReportID()
-
-	order.ReportHTML = report
-	order.ReportID = reportID
+	order.Report = report
+	if order.ReportID == "" || (order.ReportExpiresAt != nil && order.ReportExpiresAt.Before(time.Now())) {
+		if err := r.issueReportID(order); err != nil {
+			return err
+		}
+	}
 
 	if err := r.DB.Save(order).Error; err != nil {
 		return fmt.Errorf("failed to save order report: %w", err)
@@ -102,27 +216,50 @@ func (r *OrderGormRepository) SaveOrderReport(orderID uint, report string) error
 	return nil
 }
 
-// GenerateUniqueReportID generates a unique report ID, ensuring it does not exist in the database.
-func (r *OrderGormRepository) GenerateUniqueReportID() string {
-	var reportID string
-	var count int64
-	for {
-		reportID = generateRandomID(6)
-		r.DB.Model(&Order{}).Where("report_id = ?", reportID).Count(&count)
-		if count == 0 {
-			break
-		}
+// RevokeReportID replaces the report ID of an order, including a cleared one, so that links to its live page and
+// report stop working. 統計 links to the new ID.
+func (r *OrderGormRepository) RevokeReportID(orderID uint) error {
+	order := &Order{}
+	if err := r.DB.Unscoped().First(order, orderID).Error; err != nil {
+		return fmt.Errorf("failed to fetch order with ID %d: %w", orderID, err)
 	}
-	return reportID
+	if err := r.issueReportID(order); err != nil {
+		return err
+	}
+	if err := r.DB.Unscoped().Model(order).
+		Select("report_id", "report_expires_at").
+		Updates(order).Error; err != nil {
+		return fmt.Errorf("failed to revoke report ID of order %d: %w", orderID, err)
+	}
+	return nil
 }
 
-// GetOrderReportByOrderID retrieves the report HTML by order ID.
-func (r *OrderGormRepository) GetOrderReportByOrderID(orderID uint) (string, error) {
+// issueReportID gives an order a new report ID, expiring ReportLinkTTL from now. The ID is unique by the index
+// on it; a collision of random IDs this long fails the save rather than being checked for.
+func (r *OrderGormRepository) issueReportID(o *Order) error {
+	reportID, err := newReportID()
+	if err != nil {
+		return err
+	}
+	o.ReportID = reportID
+	o.ReportExpiresAt = nil
+	if r.ReportLinkTTL > 0 {
+		expiresAt := time.Now().Add(r.ReportLinkTTL)
+		o.ReportExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+// GetOrderReportByOrderID retrieves the report by order ID, including that of a cleared order.
+func (r *OrderGormRepository) GetOrderReportByOrderID(orderID uint) (*OrderReport, error) {
 	order := &Order{}
-	if err := r.DB.First(&order, "id = ?", orderID).Error; err != nil {
-		return "", err
+	if err := r.DB.Unscoped().First(&order, "id = ?", orderID).Error; err != nil {
+		return nil, err
 	}
-	return order.ReportHTML, nil
+	if order.Report == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return order.Report, nil
 }
 
 // GetOrderReportIDByOrderID retrieves the report ID by order ID.
@@ -134,15 +271,57 @@ func (r *OrderGormRepository) GetOrderReportIDByOrderID(orderID uint) (string, e
 	return order.ReportID, nil
 }
 
-// GetOrderIDByReportID retrieves the order ID by its report ID.
+// GetOrderIDByReportID retrieves the order ID by its report ID, unless the ID has expired. Cleared orders are found
+// too, as their reports are read after clearing; REPORT_LINK_TTL limits how long.
 func (r *OrderGormRepository) GetOrderIDByReportID(reportID string) (uint, error) {
 	order := &Order{}
-	if err := r.DB.First(&order, "report_id = ?", reportID).Error; err != nil {
+	if err := r.DB.Unscoped().
+		Where("report_id = ? AND (report_expires_at IS NULL OR report_expires_at > ?)", reportID, time.Now()).
+		First(&order).Error; err != nil {
 		return 0, err
 	}
 	return order.ID, nil
 }
 
+// Reports used to be stored as prebuilt HTML in report_html, which embedded display names unescaped. They are
+// rebuilt from their order details before the column is dropped.
+
+// GetOrderIDsWithLegacyReport fetches the IDs of orders, including cleared ones, whose report is only stored as HTML.
+func (r *OrderGormRepository) GetOrderIDsWithLegacyReport() ([]uint, error) {
+	var orderIDs []uint
+	if !r.DB.Migrator().HasColumn(&Order{}, "report_html") {
+		return orderIDs, nil
+	}
+	if err := r.DB.Unscoped().Model(&Order{}).
+		Where("report_html IS NOT NULL AND report_html <> '' AND report IS NULL").
+		Order("id").
+		Pluck("id", &orderIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch orders with legacy reports: %w", err)
+	}
+	return orderIDs, nil
+}
+
+// SaveLegacyReport stores the report rebuilt for an order, including a cleared one, in place of its HTML report.
+func (r *OrderGormRepository) SaveLegacyReport(orderID uint, report *OrderReport) error {
+	if err := r.DB.Unscoped().Model(&Order{Model: gorm.Model{ID: orderID}}).
+		Select("report").
+		Updates(&Order{Report: report}).Error; err != nil {
+		return fmt.Errorf("failed to save rebuilt report of order %d: %w", orderID, err)
+	}
+	return nil
+}
+
+// DropLegacyReports drops the HTML reports once they have all been rebuilt.
+func (r *OrderGormRepository) DropLegacyReports() error {
+	if !r.DB.Migrator().HasColumn(&Order{}, "report_html") {
+		return nil
+	}
+	if err := r.DB.Migrator().DropColumn(&Order{}, "report_html"); err != nil {
+		return fmt.Errorf("failed to drop Order report_html: %w", err)
+	}
+	return nil
+}
+
 // DeleteOrderByOrderID deletes an order by its ID.
 func (r *OrderGormRepository) DeleteOrderByOrderID(orderID uint) error {
 	result := r.DB.Where("id=?", orderID).Delete(&Order{})
@@ -152,13 +331,11 @@ func (r *OrderGormRepository) DeleteOrderByOrderID(orderID uint) error {
 	return nil
 }
 
-// generateRandomID is a helper function to generate random strings of a given length.
-func generateRandomID(length int) string {
-	const charset = "23456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxy="
-
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+// newReportID returns a random report ID from crypto/rand, safe to use in URL paths.
+func newReportID() (string, error) {
+	b := make([]byte, reportIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate report ID: %w", err)
 	}
-	return string(b)
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
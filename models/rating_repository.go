@@ -0,0 +1,103 @@
+package models
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rating is a score from 1 to 5 given by a participant of an order, either to the restaurant or, when
+// MenuItemID is not zero, to one of its menu items.
+type Rating struct {
+	gorm.Model
+	OrderID      uint   `gorm:"uniqueIndex:idx_ratings_order_user_item"`
+	UserID       string `gorm:"uniqueIndex:idx_ratings_order_user_item"`
+	MenuItemID   uint   `gorm:"uniqueIndex:idx_ratings_order_user_item"`
+	RestaurantID uint   `gorm:"index"`
+	Score        int
+}
+
+// RatingSummary is the average score and number of ratings of a restaurant or menu item.
+type RatingSummary struct {
+	Average float64
+	Count   int
+}
+
+// RatingRepository defines the database operations for ratings.
+type RatingRepository interface {
+	Init() error
+	SaveRating(*Rating) error
+	GetRestaurantRatingSummaries(...uint) (map[uint]RatingSummary, error)
+	GetMenuItemRatingSummaries(uint) (map[uint]RatingSummary, error)
+}
+
+// RatingGormRepository implements the RatingRepository using the Gorm library.
+type RatingGormRepository struct {
+	*BaseRepository
+}
+
+// Init initializes the rating repository and performs auto-migrations.
+func (r *RatingGormRepository) Init() error {
+	if err := r.DB.AutoMigrate(&Rating{}); err != nil {
+		return fmt.Errorf("failed to auto migrate Rating: %w", err)
+	}
+	return nil
+}
+
+// SaveRating inserts a rating, replacing the score if the user already rated the same thing in the same order.
+func (r *RatingGormRepository) SaveRating(rating *Rating) error {
+	result := r.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "order_id"}, {Name: "user_id"}, {Name: "menu_item_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"score", "updated_at"}),
+	}).Create(rating)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save rating of order %d: %w", rating.OrderID, result.Error)
+	}
+	return nil
+}
+
+// GetRestaurantRatingSummaries summarizes the ratings of the given restaurants, or of all restaurants if no
+// IDs are given, keyed by restaurant ID.
+func (r *RatingGormRepository) GetRestaurantRatingSummaries(restaurantIDs ...uint) (map[uint]RatingSummary, error) {
+	db := r.DB.Model(&Rating{}).Where("menu_item_id = 0")
+	if len(restaurantIDs) > 0 {
+		db = db.Where("restaurant_id IN ?", restaurantIDs)
+	}
+	summaries, err := summarizeRatings(db, "restaurant_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize restaurant ratings: %w", err)
+	}
+	return summaries, nil
+}
+
+// GetMenuItemRatingSummaries summarizes the ratings of the menu items of a restaurant, keyed by menu item ID.
+func (r *RatingGormRepository) GetMenuItemRatingSummaries(restaurantID uint) (map[uint]RatingSummary, error) {
+	db := r.DB.Model(&Rating{}).Where("restaurant_id = ? AND menu_item_id <> 0", restaurantID)
+	summaries, err := summarizeRatings(db, "menu_item_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize menu item ratings of restaurant %d: %w", restaurantID, err)
+	}
+	return summaries, nil
+}
+
+// summarizeRatings averages the ratings selected by db, grouped by the ID in column.
+func summarizeRatings(db *gorm.DB, column string) (map[uint]RatingSummary, error) {
+	var rows []struct {
+		ID      uint
+		Average float64
+		Count   int
+	}
+	if err := db.
+		Select(column + " AS id, AVG(score) AS average, COUNT(*) AS count").
+		Group(column).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	summaries := make(map[uint]RatingSummary, len(rows))
+	for _, row := range rows {
+		summaries[row.ID] = RatingSummary{Average: row.Average, Count: row.Count}
+	}
+	return summaries, nil
+}
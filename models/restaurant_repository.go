@@ -1,26 +1,97 @@
 package models
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ServiceMode describes how food from a restaurant reaches the office.
+type ServiceMode string
+
+const (
+	ServiceDelivery ServiceMode = "delivery"
+	ServicePickup   ServiceMode = "pickup"
 )
 
 // Restaurant represents a restaurant with its associated menu items and orders.
 type Restaurant struct {
 	gorm.Model
-	Name      string
-	Tel       string
-	MenuItems []*MenuItem
-	Orders    []*Order
+	Name         string `gorm:"uniqueIndex:idx_restaurants_name,where:deleted_at IS NULL"`
+	Tel          string
+	Address      string
+	MinimumOrder int
+	DeliveryFee  int
+	ServiceMode  ServiceMode
+	Notes        string
+	ImageURL     string
+	OpeningHours []*OpeningHour
+	MenuPhotos   []*MenuPhoto
+	Aliases      []*RestaurantAlias
+	Tags         []*Tag `gorm:"many2many:restaurant_tags"`
+	MenuItems    []*MenuItem
+	Orders       []*Order
+}
+
+// OpeningHour is a single opening period of a restaurant on a weekday.
+// Opens and Closes are formatted as zero-padded "HH:MM".
+type OpeningHour struct {
+	gorm.Model
+	RestaurantID uint
+	Weekday      time.Weekday
+	Opens        string
+	Closes       string
+}
+
+// RestaurantAlias is an alternative name a restaurant can be referred to by.
+type RestaurantAlias struct {
+	gorm.Model
+	RestaurantID uint
+	Name         string `gorm:"uniqueIndex"`
+}
+
+// Tag is a category of restaurants, such as 便當 or 素食.
+type Tag struct {
+	gorm.Model
+	Name string `gorm:"uniqueIndex"`
+}
+
+// MenuPhoto is a photo of the paper menu of a restaurant, for shops without a typed menu.
+type MenuPhoto struct {
+	gorm.Model
+	RestaurantID uint `gorm:"index"`
+	URL          string
+	PreviewURL   string // A JPEG small enough for LINE image messages, empty for photos given by URL
+}
+
+// RestaurantClosure records a one-off day on which a restaurant is closed.
+type RestaurantClosure struct {
+	gorm.Model
+	RestaurantID uint      `gorm:"uniqueIndex:idx_restaurant_closure"`
+	Date         time.Time `gorm:"type:date;uniqueIndex:idx_restaurant_closure"`
 }
 
 // RestaurantRepository defines the database operations for restaurants.
 type RestaurantRepository interface {
 	Init() error
 	CreateRestaurant(*Restaurant) error
+	UpsertRestaurant(*Restaurant) (*Restaurant, error)
+	UpdateRestaurant(*Restaurant) error
+	SetRestaurantImageURL(uint, string) error
+	AddMenuPhoto(*MenuPhoto) error
+	DeleteMenuPhotos(uint) error
+	SetOpeningHours(uint, []*OpeningHour) error
+	AddRestaurantAlias(*RestaurantAlias) error
+	AddRestaurantTags(uint, []string) error
+	AddRestaurantClosure(*RestaurantClosure) error
+	IsRestaurantClosedOn(uint, time.Time) (bool, error)
 	GetAllRestaurants() ([]*Restaurant, error)
+	GetRestaurantsByTags([]string) ([]*Restaurant, error)
 	GetRestaurantByName(string) (*Restaurant, error)
+	GetRestaurantByID(uint) (*Restaurant, error)
 	DeleteRestaurant(uint) error
 }
 
@@ -31,7 +102,12 @@ type RestaurantGormRepository struct {
 
 // Init initializes the restaurant repository and performs auto-migrations.
 func (r *RestaurantGormRepository) Init() error {
-	if err := r.DB.AutoMigrate(&Restaurant{}); err != nil {
+	if r.DB.Migrator().HasTable(&Restaurant{}) {
+		if err := r.mergeDuplicateRestaurants(); err != nil {
+			return fmt.Errorf("failed to merge duplicate restaurants: %w", err)
+		}
+	}
+	if err := r.DB.AutoMigrate(&Restaurant{}, &OpeningHour{}, &RestaurantAlias{}, &Tag{}, &RestaurantClosure{}, &MenuPhoto{}); err != nil {
 		return fmt.Errorf("failed to auto migrate Restaurant: %w", err)
 	}
 	return nil
@@ -45,24 +121,297 @@ func (r *RestaurantGormRepository) CreateRestaurant(rest *Restaurant) error {
 	return nil
 }
 
-// GetAllRestaurants fetches all restaurants from the database.
+// UpsertRestaurant creates a restaurant, or updates the non-zero profile fields of the restaurant with the same
+// name. It returns the restaurant as it was before the update, or nil if it was created.
+func (r *RestaurantGormRepository) UpsertRestaurant(rest *Restaurant) (*Restaurant, error) {
+	var previous *Restaurant
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var existing Restaurant
+		err := tx.Where("name=?", rest.Name).Take(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(rest).Error
+		} else if err != nil {
+			return err
+		}
+
+		previous = &existing
+		rest.ID = existing.ID
+		if err := tx.Model(&Restaurant{}).Where("id=?", existing.ID).Omit(clause.Associations).Updates(rest).Error; err != nil {
+			return err
+		}
+		return tx.Take(rest, existing.ID).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert restaurant %s: %w", rest.Name, err)
+	}
+	return previous, nil
+}
+
+// mergeDuplicateRestaurants moves everything of restaurants sharing a name to the oldest of them and deletes the
+// others, so that the unique index on names can be created.
+func (r *RestaurantGormRepository) mergeDuplicateRestaurants() error {
+	var duplicates []struct {
+		ID       uint
+		KeeperID uint
+	}
+	if err := r.DB.Raw(`
+		SELECT restaurants.id, keepers.id AS keeper_id
+		FROM restaurants
+		JOIN (
+			SELECT name, MIN(id) AS id FROM restaurants
+			WHERE deleted_at IS NULL
+			GROUP BY name
+		) AS keepers ON restaurants.name = keepers.name
+		WHERE restaurants.deleted_at IS NULL AND restaurants.id <> keepers.id`).
+		Scan(&duplicates).Error; err != nil {
+		return err
+	}
+
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		for _, d := range duplicates {
+			if err := mergeRestaurant(tx, d.ID, d.KeeperID); err != nil {
+				return fmt.Errorf("failed to merge restaurant %d into %d: %w", d.ID, d.KeeperID, err)
+			}
+			if err := tx.Delete(&Restaurant{}, d.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeRestaurant moves the rows of every table keyed by restaurant_id from a duplicate restaurant to its keeper
+// within tx. What would clash with the keeper is left behind, to be deleted with the duplicate:
+//   - menu items named like an item of the keeper are deleted; the others are numbered after the codes of the
+//     keeper, or left for the code backfill if the keeper has none yet
+//   - opening hours, unless the keeper has none
+//   - closures on days the keeper is already closed
+//   - tags the keeper already has
+func mergeRestaurant(tx *gorm.DB, id, keeperID uint) error {
+	exec := func(table, sql string, values ...interface{}) error {
+		if !tx.Migrator().HasTable(table) {
+			return nil
+		}
+		return tx.Exec(sql, values...).Error
+	}
+
+	if err := exec("menu_items", `
+		UPDATE menu_items SET deleted_at = NOW()
+		WHERE restaurant_id = ? AND deleted_at IS NULL
+			AND name IN (SELECT name FROM menu_items WHERE restaurant_id = ? AND deleted_at IS NULL)`,
+		id, keeperID); err != nil {
+		return err
+	}
+	if tx.Migrator().HasColumn("menu_items", "code") {
+		if err := tx.Exec(`
+			UPDATE menu_items
+			SET code = CASE WHEN keeper.code = 0 THEN 0 ELSE keeper.code + moved.seq END
+			FROM (
+				SELECT id, ROW_NUMBER() OVER (ORDER BY code, id) AS seq
+				FROM menu_items WHERE restaurant_id = ?
+			) AS moved,
+			(SELECT COALESCE(MAX(code), 0) AS code FROM menu_items WHERE restaurant_id = ?) AS keeper
+			WHERE menu_items.id = moved.id`,
+			id, keeperID).Error; err != nil {
+			return err
+		}
+	}
+
+	if err := exec("opening_hours", `
+		DELETE FROM opening_hours
+		WHERE restaurant_id = ?
+			AND EXISTS (SELECT 1 FROM opening_hours WHERE restaurant_id = ? AND deleted_at IS NULL)`,
+		id, keeperID); err != nil {
+		return err
+	}
+	if err := exec("restaurant_closures", `
+		DELETE FROM restaurant_closures
+		WHERE restaurant_id = ?
+			AND date IN (SELECT date FROM restaurant_closures WHERE restaurant_id = ?)`,
+		id, keeperID); err != nil {
+		return err
+	}
+	if err := exec("restaurant_tags", `
+		DELETE FROM restaurant_tags
+		WHERE restaurant_id = ?
+			AND tag_id IN (SELECT tag_id FROM restaurant_tags WHERE restaurant_id = ?)`,
+		id, keeperID); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"menu_items", "orders", "opening_hours", "restaurant_aliases", "restaurant_closures", "restaurant_tags", "menu_photos", "ratings"} {
+		if err := exec(table, "UPDATE "+table+" SET restaurant_id = ? WHERE restaurant_id = ?", keeperID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateRestaurant saves the profile fields of an existing restaurant.
+func (r *RestaurantGormRepository) UpdateRestaurant(rest *Restaurant) error {
+	if err := r.DB.Omit("OpeningHours", "MenuPhotos", "MenuItems", "Orders").Save(rest).Error; err != nil {
+		return fmt.Errorf("failed to update restaurant %s: %w", rest.Name, err)
+	}
+	return nil
+}
+
+// SetRestaurantImageURL sets the image shown in the menu of a restaurant.
+func (r *RestaurantGormRepository) SetRestaurantImageURL(restaurantID uint, imageURL string) error {
+	if err := r.DB.Model(&Restaurant{}).Where("id=?", restaurantID).Update("image_url", imageURL).Error; err != nil {
+		return fmt.Errorf("failed to set image of restaurant %d: %w", restaurantID, err)
+	}
+	return nil
+}
+
+// AddMenuPhoto adds a photo of the paper menu of a restaurant.
+func (r *RestaurantGormRepository) AddMenuPhoto(photo *MenuPhoto) error {
+	if err := r.DB.Create(photo).Error; err != nil {
+		return fmt.Errorf("failed to add menu photo of restaurant %d: %w", photo.RestaurantID, err)
+	}
+	return nil
+}
+
+// DeleteMenuPhotos deletes all menu photos of a restaurant.
+func (r *RestaurantGormRepository) DeleteMenuPhotos(restaurantID uint) error {
+	if err := r.DB.Where("restaurant_id=?", restaurantID).Delete(&MenuPhoto{}).Error; err != nil {
+		return fmt.Errorf("failed to delete menu photos of restaurant %d: %w", restaurantID, err)
+	}
+	return nil
+}
+
+// SetOpeningHours replaces the weekly opening hours of a restaurant.
+func (r *RestaurantGormRepository) SetOpeningHours(restaurantID uint, hours []*OpeningHour) error {
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("restaurant_id=?", restaurantID).Delete(&OpeningHour{}).Error; err != nil {
+			return err
+		}
+		for _, h := range hours {
+			h.RestaurantID = restaurantID
+		}
+		if len(hours) == 0 {
+			return nil
+		}
+		return tx.Create(hours).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set opening hours of restaurant %d: %w", restaurantID, err)
+	}
+	return nil
+}
+
+// AddRestaurantAlias inserts a new alias of a restaurant into the database.
+func (r *RestaurantGormRepository) AddRestaurantAlias(alias *RestaurantAlias) error {
+	if err := r.DB.Create(alias).Error; err != nil {
+		return fmt.Errorf("failed to add alias %s of restaurant %d: %w", alias.Name, alias.RestaurantID, err)
+	}
+	return nil
+}
+
+// AddRestaurantTags tags a restaurant, creating tags that do not exist yet.
+func (r *RestaurantGormRepository) AddRestaurantTags(restaurantID uint, names []string) error {
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var tags []*Tag
+		for _, name := range names {
+			tag := &Tag{}
+			if err := tx.Where(Tag{Name: name}).FirstOrCreate(tag).Error; err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+		return tx.Model(&Restaurant{Model: gorm.Model{ID: restaurantID}}).Association("Tags").Append(tags)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add tags to restaurant %d: %w", restaurantID, err)
+	}
+	return nil
+}
+
+// AddRestaurantClosure records a closing day of a restaurant. Recording the same day twice is a no-op.
+func (r *RestaurantGormRepository) AddRestaurantClosure(closure *RestaurantClosure) error {
+	if err := r.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(closure).Error; err != nil {
+		return fmt.Errorf("failed to add closure of restaurant %d: %w", closure.RestaurantID, err)
+	}
+	return nil
+}
+
+// IsRestaurantClosedOn reports whether a closing day is recorded for the restaurant on the date of t.
+func (r *RestaurantGormRepository) IsRestaurantClosedOn(restaurantID uint, t time.Time) (bool, error) {
+	var count int64
+	result := r.DB.Model(&RestaurantClosure{}).
+		Where("restaurant_id=? AND date=?", restaurantID, t.Format("2006-01-02")).
+		Count(&count)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to check closure of restaurant %d: %w", restaurantID, result.Error)
+	}
+	return count > 0, nil
+}
+
+// GetAllRestaurants fetches all restaurants and their aliases from the database.
 func (r *RestaurantGormRepository) GetAllRestaurants() ([]*Restaurant, error) {
 	var restaurants []*Restaurant
-	if err := r.DB.Find(&restaurants).Error; err != nil {
+	if err := r.DB.Preload("Aliases").Find(&restaurants).Error; err != nil {
 		return nil, fmt.Errorf("failed to fetch all restaurants: %w", err)
 	}
 	return restaurants, nil
 }
 
-// GetRestaurantByName fetches a restaurant by its name from the database.
+// GetRestaurantsByTags fetches the restaurants with any of the given tags, or all restaurants if no tags are
+// given, together with their opening hours and tags.
+func (r *RestaurantGormRepository) GetRestaurantsByTags(tags []string) ([]*Restaurant, error) {
+	var restaurants []*Restaurant
+	db := r.DB.Preload("OpeningHours").Preload("Tags")
+	if len(tags) > 0 {
+		db = db.Where("id IN (?)", r.DB.
+			Table("restaurant_tags").
+			Select("restaurant_tags.restaurant_id").
+			Joins("JOIN tags ON tags.id = restaurant_tags.tag_id").
+			Where("tags.name IN ?", tags))
+	}
+	if err := db.Find(&restaurants).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch restaurants by tags %v: %w", tags, err)
+	}
+	return restaurants, nil
+}
+
+// GetRestaurantByName fetches a restaurant, its opening hours and tags by its name from the database.
 func (r *RestaurantGormRepository) GetRestaurantByName(name string) (*Restaurant, error) {
 	var restaurant Restaurant
-	if err := r.DB.Where("name=?", name).First(&restaurant).Error; err != nil {
+	if err := r.DB.
+		Preload("OpeningHours", func(db *gorm.DB) *gorm.DB {
+			return db.Order("weekday, opens")
+		}).
+		Preload("Tags").
+		Preload("MenuPhotos", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id")
+		}).
+		Where("name=?", name).
+		First(&restaurant).Error; err != nil {
 		return nil, fmt.Errorf("failed to fetch restaurant by name %s: %w", name, err)
 	}
 	return &restaurant, nil
 }
 
+// GetRestaurantByID fetches a restaurant with its opening hours, aliases, tags and menu items by its ID from the
+// database.
+func (r *RestaurantGormRepository) GetRestaurantByID(ID uint) (*Restaurant, error) {
+	var restaurant Restaurant
+	if err := r.DB.
+		Preload("OpeningHours", func(db *gorm.DB) *gorm.DB {
+			return db.Order("weekday, opens")
+		}).
+		Preload("Aliases").
+		Preload("Tags").
+		Preload("MenuItems", func(db *gorm.DB) *gorm.DB {
+			return db.Order("code")
+		}).
+		Preload("MenuItems.ComboSlots", orderByPosition).
+		Preload("MenuItems.ComboSlots.Options", orderByCode).
+		First(&restaurant, ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch restaurant by ID %d: %w", ID, err)
+	}
+	return &restaurant, nil
+}
+
 // DeleteRestaurant removes a restaurant by its ID from the database.
 func (r *RestaurantGormRepository) DeleteRestaurant(ID uint) error {
 	var restaurant Restaurant